@@ -6,15 +6,18 @@ package buntdb
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"os"
 	"runtime"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/tidwall/btree"
@@ -60,6 +63,22 @@ var (
 
 	// ErrTxIterating is returned when Set or Delete are called while iterating.
 	ErrTxIterating = errors.New("tx is iterating")
+
+	// ErrConditionFailed is returned when the condition of a conditional
+	// write operation is not met.
+	ErrConditionFailed = errors.New("condition failed")
+
+	// ErrNotNumber is returned when incrementing a value that is not a
+	// number.
+	ErrNotNumber = errors.New("value is not a number")
+
+	// ErrConflict is returned when committing an optimistic transaction that
+	// depends on keys which were changed by another transaction.
+	ErrConflict = errors.New("tx conflict")
+
+	// ErrWatchedKeyChanged is returned by Assert when a key of a WatchToken
+	// was modified after it was watched.
+	ErrWatchedKeyChanged = errors.New("watched key changed")
 )
 
 const useAbsEx = true
@@ -68,6 +87,7 @@ const useAbsEx = true
 // Transactions are used for all forms of data access to the DB.
 type DB struct {
 	mu        sync.RWMutex      // the gatekeeper for all fields
+	snapmu    sync.Mutex        // serializes copying trees for snapshots
 	file      *os.File          // the underlying file
 	buf       []byte            // a buffer to write to
 	keys      *btree.BTree      // a tree of all item ordered by key
@@ -75,6 +95,27 @@ type DB struct {
 	idxs      map[string]*index // the index trees.
 	insIdxs   []*index          // a reuse buffer for gathering indexes
 	flushes   int               // a count of the number of disk flushes
+	commits   uint64            // a count of the commits that changed data
+	vers      uint64            // the version of the last stored item
+	tombs     []uint64          // versions of deleted items, by key hash
+	flushver  uint64            // the last version before a deleteAll
+	seq       uint64            // the sequence number of the last change batch
+	changelog changeLog         // retained change batches for subscribers
+	notifiers notifiers         // keyspace event subscribers
+	touchmu   sync.Mutex        // guards the touches field
+	touches   map[string]touch  // expirations touched by read-only txs
+	expstats  ExpirationStats   // metrics of the expiration sweeps
+	expnext   *dbItem           // the last item reported by a limited sweep
+	sweepmu   sync.Mutex        // serializes the expiration sweeps
+	txmu      sync.Mutex        // guards the opentxs and close fields
+	opentxs   int               // the number of open locking transactions
+	closing   bool              // set when the database has begun closing
+	closedone chan struct{}     // closed when the database has been closed
+	closeerr  error             // the error of closing the database
+	closeseen bool              // the close result has been returned
+	aborted   int32             // set to abort the open transactions
+	bgstop    chan struct{}     // closed to stop the background manager
+	bgdone    chan struct{}     // closed when the background manager exits
 	closed    bool              // set when the database has been closed
 	config    Config            // the database configuration
 	persist   bool              // do we write to disk
@@ -132,6 +173,190 @@ type Config struct {
 	// deletion of the timeed-out item is the explicit responsibility of this
 	// callback.
 	OnExpiredSync func(key, value string, tx *Tx) error
+
+	// OnExpiry is called with an event for each item that is removed because
+	// it expired. Unlike with OnExpired and OnExpiredSync, the items are
+	// deleted by the database, and those callbacks take precedence when
+	// present. The function is called with a nil tx after the deletion has
+	// been committed, unless ExpiryInTx is set. Without an ExpiryOutbox, an
+	// error is ignored.
+	OnExpiry func(ev ExpiryEvent, tx *Tx) error
+
+	// ExpiryInTx calls OnExpiry inside the same transaction that deletes the
+	// expired items. The function is called before the item is deleted.
+	// Returning an error skips the deletion of that item, which is retried
+	// by the next sweep, while the rest of the items are still deleted. The
+	// skipped items don't count against MaxExpirationsPerSweep. Any changes
+	// that the function made before returning the error are kept.
+	ExpiryInTx bool
+
+	// ExpiryChannel receives an event for each item that is removed because
+	// it expired, after the deletion has been committed. The expiration
+	// process blocks while the channel is full, rather than dropping events.
+	ExpiryChannel chan<- ExpiryEvent
+
+	// ExpiryOutbox is a key prefix for storing the expiry events that have
+	// not yet been delivered to OnExpiry, when called after the commit, or
+	// to ExpiryChannel. An outbox key is set in the same transaction that
+	// deletes the expired item, and deleted once the event is delivered.
+	// Events that were not delivered, due to a crash or an error returned by
+	// OnExpiry, are delivered again by a later sweep, up to
+	// MaxExpirationsPerSweep at a time. An outbox key is the prefix, followed
+	// by the expiration as Unix seconds padded to 20 digits, a dot, the
+	// nanoseconds padded to 9 digits, a colon, and the key. Its value is the
+	// value of the item.
+	//
+	// Outbox keys are ordinary keys. They are persisted, counted by Len, and
+	// visited by scans and indexes that match them, and setting or deleting
+	// them is reported to OnCommit, Subscribe, and Notify like any other
+	// change. Use a prefix that the application doesn't otherwise use.
+	ExpiryOutbox string
+
+	// DeferIteratingMutations allows for Set and Delete to be called from
+	// inside the iterator functions of Ascend* and Descend*. Such mutations
+	// are deferred until the outermost iteration of the transaction has
+	// completed, and then applied in a batch. The iterations that are in
+	// progress do not see the deferred mutations, but Get, TTL, Set, and
+	// Delete do.
+	// When this is false, ErrTxIterating is returned instead.
+	DeferIteratingMutations bool
+
+	// MaxExpirationsPerSweep limits the number of expired items that the
+	// background process removes while holding the database lock. When
+	// there are more, the sweeps happen ten times per second until the
+	// backlog is cleared. With OnExpired or OnExpiredSync, which may leave
+	// the items in place, each sweep reports the items that follow the ones
+	// reported by the previous sweep. Zero means no limit.
+	MaxExpirationsPerSweep int
+
+	// OnCommit is called with the changes of every writable transaction
+	// that is successfully committed, including the deletions performed by
+	// DeleteAll and by the background expiration of items. The changes are
+	// ordered by key. This function is called after the database lock has
+	// been released, and from the same goroutine that committed the
+	// transaction.
+	OnCommit func(changes []Change)
+
+	// ChangeRetention enables change data capture when greater than zero.
+	// Each committed transaction that changes data is then assigned a
+	// sequence number, which is persisted along with the data, and the
+	// most recent ChangeRetention change batches are retained in memory for
+	// subscribers. See DB.Subscribe.
+	ChangeRetention int
+
+	// Clock provides the current time for the expiration of items. The
+	// default is the system clock. A ManualClock makes expirations
+	// deterministic in tests, along with DB.SweepExpired. Items that are
+	// loaded from disk when the database is opened are evaluated with the
+	// system clock, because the Clock is set after opening. Items that are
+	// read by DB.Load use this clock.
+	Clock Clock
+
+	// TTLPolicies are the default time-to-live of the keys that are set
+	// without an expiration. The first policy with a pattern that matches
+	// the key is used. A policy applies when a key is created by IncrBy,
+	// IncrByFloat, Append, or SetRange without options, but those calls, and
+	// CompareAndSwap, keep the expiration of a key that already exists. See
+	// TTLPolicy.
+	TTLPolicies []TTLPolicy
+}
+
+// TTLPolicy is a default time-to-live for the keys that match a pattern. It
+// applies to Set calls that do not specify an expiration, unless the Persist
+// option is used, or the KeepTTL option retains the expiration of an
+// existing key.
+type TTLPolicy struct {
+	// Pattern is matched against the keys in the same way as the pattern of
+	// an index, where '*' matches any characters and '?' matches one.
+	Pattern string
+	// TTL is the time-to-live of the matching keys. Zero means that the
+	// matching keys do not expire, which can exempt them from the policies
+	// that follow.
+	TTL time.Duration
+}
+
+// Clock is a source of the current time.
+type Clock interface {
+	Now() time.Time
+}
+
+// ManualClock is a Clock that only changes when it is told to. It's safe for
+// concurrent use.
+type ManualClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewManualClock returns a new ManualClock that is set to the provided time.
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{now: now}
+}
+
+// Now returns the current time of the clock.
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Set sets the current time of the clock.
+func (c *ManualClock) Set(now time.Time) {
+	c.mu.Lock()
+	c.now = now
+	c.mu.Unlock()
+}
+
+// Advance moves the current time of the clock forward by the duration.
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+// now returns the current time of the database clock. The caller must hold
+// the database lock.
+func (db *DB) now() time.Time {
+	if db.config.Clock != nil {
+		return db.config.Clock.Now()
+	}
+	return time.Now()
+}
+
+// Change represents a single key that was modified by a committed
+// transaction.
+type Change struct {
+	// Key is the key that changed.
+	Key string
+	// OldValue is the value prior to the transaction, and is only valid when
+	// Existed is true. An item that had expired, but was not yet removed by
+	// the background process, still counts as existing.
+	OldValue string
+	// Existed is true when the key existed prior to the transaction.
+	Existed bool
+	// NewValue is the value after the transaction. This is empty when
+	// Deleted is true.
+	NewValue string
+	// TTL is the remaining time-to-live of the new value at the time of the
+	// commit. Zero means that the value does not expire.
+	TTL time.Duration
+	// Deleted is true when the key was deleted.
+	Deleted bool
+	// Expired is true when the key was deleted by the background process
+	// because it expired.
+	Expired bool
+}
+
+// ExpiryEvent represents an item that was removed because it expired.
+type ExpiryEvent struct {
+	// Key is the key of the item.
+	Key string
+	// Value is the value of the item.
+	Value string
+	// ExpiresAt is when the item expired.
+	ExpiresAt time.Time
+	// InTx is true when the event is delivered inside the transaction that
+	// deletes the item.
+	InTx bool
 }
 
 // exctx is a simple b-tree context for ordering by expiration.
@@ -146,7 +371,10 @@ func Open(path string) (*DB, error) {
 	// initialize trees and indexes
 	db.keys = btreeNew(lessCtx(nil))
 	db.exps = btreeNew(lessCtx(&exctx{db}))
+	db.tombs = make([]uint64, numTombs)
 	db.idxs = make(map[string]*index)
+	db.bgstop = make(chan struct{})
+	db.bgdone = make(chan struct{})
 	// initialize default configuration
 	db.config = Config{
 		SyncPolicy:           EverySecond,
@@ -175,14 +403,75 @@ func Open(path string) (*DB, error) {
 }
 
 // Close releases all database resources.
-// All transactions must be closed before closing the database.
+// It waits for the open transactions to be closed. See CloseContext.
 func (db *DB) Close() error {
-	db.mu.Lock()
-	defer db.mu.Unlock()
-	if db.closed {
-		return ErrDatabaseClosed
+	_, err := db.CloseContext(context.Background())
+	return err
+}
+
+// CloseContext closes the database once all of the open transactions have
+// finished. New transactions are not allowed from the moment it's called.
+// When the context is done before the open transactions have finished, the
+// iterations of those transactions are aborted with ErrDatabaseClosed and
+// the context's error is returned along with the number of transactions
+// that were still open. The database is then closed as soon as those
+// transactions are committed or rolled back. Until then a later call to Close
+// or CloseContext waits for the close to finish, and returns its result.
+// ErrDatabaseClosed is returned once the result has been returned.
+func (db *DB) CloseContext(ctx context.Context) (open int, err error) {
+	db.txmu.Lock()
+	if db.closing {
+		done := db.closedone
+		db.txmu.Unlock()
+		return db.waitClose(ctx, done)
+	}
+	db.closing = true
+	done := make(chan struct{})
+	db.closedone = done
+	db.txmu.Unlock()
+	// stop the background manager, it may be using the database.
+	close(db.bgstop)
+	go func() {
+		<-db.bgdone
+		db.mu.Lock()
+		err := db.close()
+		db.mu.Unlock()
+		db.txmu.Lock()
+		db.closeerr = err
+		db.txmu.Unlock()
+		close(done)
+	}()
+	return db.waitClose(ctx, done)
+}
+
+// waitClose waits for the database to be closed, or for the context to be
+// done, in which case the open transactions are aborted.
+func (db *DB) waitClose(ctx context.Context, done chan struct{}) (open int,
+	err error) {
+	select {
+	case <-done:
+		db.txmu.Lock()
+		defer db.txmu.Unlock()
+		if db.closeseen {
+			return 0, ErrDatabaseClosed
+		}
+		db.closeseen = true
+		return 0, db.closeerr
+	case <-ctx.Done():
+		atomic.StoreInt32(&db.aborted, 1)
+		db.txmu.Lock()
+		open = db.opentxs
+		db.txmu.Unlock()
+		return open, ctx.Err()
 	}
+}
+
+// close releases all database resources.
+// This must be called while holding the database lock.
+func (db *DB) close() error {
 	db.closed = true
+	db.changelog.close()
+	db.notifiers.close()
 	if db.persist {
 		db.file.Sync() // do a sync but ignore the error
 		if err := db.file.Close(); err != nil {
@@ -195,6 +484,32 @@ func (db *DB) Close() error {
 	return nil
 }
 
+// trackTx counts a transaction that is beginning. Returns ErrDatabaseClosed
+// when the database is closing.
+func (db *DB) trackTx() error {
+	db.txmu.Lock()
+	defer db.txmu.Unlock()
+	if db.closing {
+		return ErrDatabaseClosed
+	}
+	db.opentxs++
+	return nil
+}
+
+// isClosing returns true when the database has begun closing.
+func (db *DB) isClosing() bool {
+	db.txmu.Lock()
+	defer db.txmu.Unlock()
+	return db.closing
+}
+
+// untrackTx is called when a transaction counted by trackTx has finished.
+func (db *DB) untrackTx() {
+	db.txmu.Lock()
+	db.opentxs--
+	db.txmu.Unlock()
+}
+
 // Save writes a snapshot of the database to a writer. This operation blocks all
 // writes, but not reads. This can be used for snapshots and backups for pure
 // in-memory databases using the ":memory:". Database that persist to disk
@@ -205,7 +520,10 @@ func (db *DB) Save(wr io.Writer) error {
 	defer db.mu.RUnlock()
 	// use a buffered writer and flush every 4MB
 	var buf []byte
-	now := time.Now()
+	if db.seq > 0 {
+		buf = appendSeq(buf, db.seq)
+	}
+	now := db.now()
 	// iterated through every item in the database and write to the buffer
 	btreeAscend(db.keys, func(item interface{}) bool {
 		dbi := item.(*dbItem)
@@ -243,7 +561,7 @@ func (db *DB) Load(rd io.Reader) error {
 		// cannot load into databases that persist to disk
 		return ErrPersistenceActive
 	}
-	_, err := db.readLoad(rd, time.Now())
+	_, err := db.readLoad(rd, db.now())
 	return err
 }
 
@@ -256,6 +574,7 @@ type index struct {
 	pattern string                                 // a required key pattern
 	less    func(a, b string) bool                 // less comparison function
 	rect    func(item string) (min, max []float64) // rect from string function
+	fields  []IndexField                           // composite index fields
 	db      *DB                                    // the origin database
 	opts    IndexOptions                           // index options
 }
@@ -285,6 +604,7 @@ func (idx *index) clearCopy() *index {
 		db:      idx.db,
 		less:    idx.less,
 		rect:    idx.rect,
+		fields:  idx.fields,
 		opts:    idx.opts,
 	}
 	// initialize with empty trees
@@ -297,6 +617,25 @@ func (idx *index) clearCopy() *index {
 	return nidx
 }
 
+// spatial returns the r-tree of the index, or nil when the index is not a
+// spatial index. The r-tree of a snapshot index is built on first use.
+func (idx *index) spatial() *rtred.RTree {
+	if idx.rect == nil {
+		return nil
+	}
+	if idx.rtr == nil {
+		idx.rtr = rtred.New(idx)
+		btreeAscend(idx.db.keys, func(item interface{}) bool {
+			dbi := item.(*dbItem)
+			if idx.match(dbi.key) {
+				idx.rtr.Insert(dbi)
+			}
+			return true
+		})
+	}
+	return idx.rtr
+}
+
 // rebuild rebuilds the index
 func (idx *index) rebuild() {
 	// initialize trees
@@ -323,6 +662,47 @@ func (idx *index) rebuild() {
 	})
 }
 
+// tuplePivot is a pivot for a composite index, with a value for each of the
+// leading fields. The missing fields are lower than any value, or higher
+// than any value when high is set.
+type tuplePivot struct {
+	fields []string
+	high   bool
+}
+
+// comparePivot returns -1 when the pivot is less than the item, or +1 when
+// it's greater. A pivot with all of the fields is less than the items with
+// equal fields.
+func (idx *index) comparePivot(pivot *tuplePivot, dbi *dbItem) int {
+	for i, field := range idx.fields {
+		if i == len(pivot.fields) {
+			if pivot.high {
+				return +1
+			}
+			return -1
+		}
+		value := field.Extract(dbi.val)
+		if field.Less(pivot.fields[i], value) {
+			return -1
+		}
+		if field.Less(value, pivot.fields[i]) {
+			return +1
+		}
+	}
+	return -1
+}
+
+// compositeLess is the b-tree less function of a composite index.
+func (idx *index) compositeLess(a, b interface{}) bool {
+	if pivot, ok := a.(*tuplePivot); ok {
+		return idx.comparePivot(pivot, b.(*dbItem)) < 0
+	}
+	if pivot, ok := b.(*tuplePivot); ok {
+		return idx.comparePivot(pivot, a.(*dbItem)) > 0
+	}
+	return a.(*dbItem).Less(b.(*dbItem), idx)
+}
+
 // CreateIndex builds a new index and populates it with items.
 // The items are ordered in an b-tree and can be retrieved using the
 // Ascend* and Descend* methods.
@@ -367,6 +747,16 @@ func (db *DB) ReplaceIndex(name, pattern string,
 	})
 }
 
+// CreateCompositeIndex builds a new index over several fields that are
+// extracted from the values, and populates it with items.
+// See Tx.CreateCompositeIndex.
+func (db *DB) CreateCompositeIndex(name, pattern string,
+	fields ...IndexField) error {
+	return db.Update(func(tx *Tx) error {
+		return tx.CreateCompositeIndex(name, pattern, fields...)
+	})
+}
+
 // CreateSpatialIndex builds a new index and populates it with items.
 // The items are organized in an r-tree and can be retrieved using the
 // Intersects method.
@@ -436,6 +826,7 @@ func (db *DB) ReadConfig(config *Config) error {
 		return ErrDatabaseClosed
 	}
 	*config = db.config
+	config.TTLPolicies = append([]TTLPolicy(nil), db.config.TTLPolicies...)
 	return nil
 }
 
@@ -451,14 +842,51 @@ func (db *DB) SetConfig(config Config) error {
 		return ErrInvalidSyncPolicy
 	case Never, EverySecond, Always:
 	}
+	config.TTLPolicies = append([]TTLPolicy(nil), config.TTLPolicies...)
 	db.config = config
 	return nil
 }
 
+// TTLPolicy returns the policy that provides the default time-to-live of the
+// key, if any.
+func (db *DB) TTLPolicy(key string) (policy TTLPolicy, ok bool, err error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return TTLPolicy{}, false, ErrDatabaseClosed
+	}
+	policy, ok = db.ttlPolicy(key)
+	return policy, ok, nil
+}
+
+// ttlPolicy returns the first TTL policy that matches the key.
+func (db *DB) ttlPolicy(key string) (TTLPolicy, bool) {
+	for _, policy := range db.config.TTLPolicies {
+		if match.Match(key, policy.Pattern) {
+			return policy, true
+		}
+	}
+	return TTLPolicy{}, false
+}
+
+// defaultOpts returns the item options for a key that is set without an
+// expiration, according to the TTL policies.
+func (db *DB) defaultOpts(key string, now time.Time) *dbItemOpts {
+	policy, ok := db.ttlPolicy(key)
+	if !ok || policy.TTL <= 0 {
+		return nil
+	}
+	return &dbItemOpts{ex: true, exat: now.Add(policy.TTL)}
+}
+
 // insertIntoDatabase performs inserts an item in to the database and updates
 // all indexes. If a previous item with the same key already exists, that item
 // will be replaced with the new one, and return the previous item.
 func (db *DB) insertIntoDatabase(item *dbItem) *dbItem {
+	if item.ver == 0 {
+		db.vers++
+		item.ver = db.vers
+	}
 	var pdbi *dbItem
 	// Generate a list of indexes that this item will be inserted in to.
 	idxs := db.insIdxs
@@ -545,25 +973,50 @@ func (db *DB) deleteFromDatabase(item *dbItem) *dbItem {
 // backgroundManager runs continuously in the background and performs various
 // operations such as removing expired items and syncing to disk.
 func (db *DB) backgroundManager() {
+	defer close(db.bgdone)
 	flushes := 0
 	t := time.NewTicker(time.Second)
 	defer t.Stop()
-	for range t.C {
+	for {
+		select {
+		case <-t.C:
+		case <-db.bgstop:
+			return
+		}
+		more, err := db.sweep()
+		if err == ErrDatabaseClosed {
+			break
+		}
+		// When a sweep is cut short by the MaxExpirationsPerSweep limit,
+		// keep sweeping the backlog more frequently until the next tick.
+		for i := 1; more && i < int(time.Second/fastSweepInterval); i++ {
+			select {
+			case <-time.After(fastSweepInterval):
+			case <-db.bgstop:
+				return
+			}
+			if more, err = db.sweep(); err == ErrDatabaseClosed {
+				return
+			}
+		}
+
+		// execute a disk sync, if needed
 		var shrink bool
-		// Open a standard view. This will take a full lock of the
-		// database thus allowing for access to anything we need.
-		var onExpired func([]string)
-		var expired []*dbItem
-		var onExpiredSync func(key, value string, tx *Tx) error
-		err := db.Update(func(tx *Tx) error {
-			onExpired = db.config.OnExpired
-			if onExpired == nil {
-				onExpiredSync = db.config.OnExpiredSync
+		func() {
+			db.mu.Lock()
+			defer db.mu.Unlock()
+			if db.closed {
+				return
+			}
+			if db.persist && db.config.SyncPolicy == EverySecond &&
+				flushes != db.flushes {
+				_ = db.file.Sync()
+				flushes = db.flushes
 			}
 			if db.persist && !db.config.AutoShrinkDisabled {
 				pos, err := db.file.Seek(0, 1)
 				if err != nil {
-					return err
+					return
 				}
 				aofsz := int(pos)
 				if aofsz > db.config.AutoShrinkMinSize {
@@ -571,66 +1024,329 @@ func (db *DB) backgroundManager() {
 					shrink = aofsz > db.lastaofsz+int(float64(db.lastaofsz)*prc)
 				}
 			}
-			// produce a list of expired items that need removing
-			btreeAscendLessThan(db.exps, &dbItem{
-				opts: &dbItemOpts{ex: true, exat: time.Now()},
-			}, func(item interface{}) bool {
-				expired = append(expired, item.(*dbItem))
-				return true
-			})
-			if onExpired == nil && onExpiredSync == nil {
-				for _, itm := range expired {
-					if _, err := tx.Delete(itm.key); err != nil {
-						// it's ok to get a "not found" because the
-						// 'Delete' method reports "not found" for
-						// expired items.
-						if err != ErrNotFound {
-							return err
+		}()
+		if shrink {
+			if err = db.Shrink(); err != nil {
+				if err == ErrDatabaseClosed {
+					break
+				}
+			}
+		}
+	}
+}
+
+// fastSweepInterval is the time between sweeps while there is a backlog of
+// expired items.
+const fastSweepInterval = time.Second / 10
+
+// sweep removes the expired items from the database, up to the
+// MaxExpirationsPerSweep limit. Returns true when the limit was reached and
+// the sweep made progress, meaning that another sweep should follow soon.
+func (db *DB) sweep() (more bool, err error) {
+	db.sweepmu.Lock()
+	defer db.sweepmu.Unlock()
+	// Open a standard view. This will take a full lock of the
+	// database thus allowing for access to anything we need.
+	var onExpired func([]string)
+	var expired []*dbItem
+	var onExpiredSync func(key, value string, tx *Tx) error
+	var onExpiry func(ev ExpiryEvent, tx *Tx) error
+	var expiryC chan<- ExpiryEvent
+	var outbox string
+	var events []ExpiryEvent
+	var outboxKeys []string
+	var outboxLimited bool
+	var start time.Time
+	// the items that were touched are refreshed when the transaction begins,
+	// before they are removed.
+	err = db.Update(func(tx *Tx) error {
+		start = time.Now()
+		onExpired = db.config.OnExpired
+		if onExpired == nil {
+			onExpiredSync = db.config.OnExpiredSync
+		}
+		// produce a list of expired items that need removing
+		max := db.config.MaxExpirationsPerSweep
+		pivot := &dbItem{opts: &dbItemOpts{ex: true, exat: db.now()}}
+		// The OnExpired and OnExpiredSync callbacks may leave the items in
+		// place, so a limited sweep continues after the items that were
+		// reported last, rather than reporting the same items again.
+		reporting := onExpired != nil || onExpiredSync != nil
+		var from *dbItem
+		if reporting {
+			from = db.expnext
+		}
+		var limited bool
+		expired, limited = db.expiredItems(from, pivot, max)
+		if len(expired) > 0 {
+			tx.wc.expired = make(map[string]bool, len(expired))
+			for _, itm := range expired {
+				tx.wc.expired[itm.key] = true
+			}
+		}
+		before := db.exps.Len()
+		var skipped int
+		if onExpired == nil && onExpiredSync == nil {
+			var onExpiryTx func(ev ExpiryEvent, tx *Tx) error
+			onExpiry = db.config.OnExpiry
+			if db.config.ExpiryInTx {
+				onExpiryTx, onExpiry = onExpiry, nil
+			}
+			expiryC = db.config.ExpiryChannel
+			if onExpiry != nil || expiryC != nil {
+				outbox = db.config.ExpiryOutbox
+			}
+			if outbox != "" {
+				// retry the events that were not delivered before
+				events, outboxKeys = tx.outboxEvents(outbox, max)
+				outboxLimited = max > 0 && len(events) == max
+			}
+			for i := 0; i < len(expired); i++ {
+				itm := expired[i]
+				ev := ExpiryEvent{Key: itm.key, Value: itm.val,
+					ExpiresAt: itm.opts.exat}
+				if onExpiryTx != nil {
+					ev.InTx = true
+					if err := onExpiryTx(ev, tx); err != nil {
+						// Keep the item for the next sweep, and take
+						// the next expired item in its place, so that
+						// failing items don't use up the limit.
+						delete(tx.wc.expired, itm.key)
+						skipped++
+						if limited {
+							var next []*dbItem
+							next, limited = db.expiredItems(
+								expired[len(expired)-1], pivot, 1)
+							for _, itm := range next {
+								tx.wc.expired[itm.key] = true
+							}
+							expired = append(expired, next...)
 						}
+						continue
+					}
+					ev.InTx = false
+				}
+				if _, err := tx.Delete(itm.key); err != nil {
+					// it's ok to get a "not found" because the
+					// 'Delete' method reports "not found" for
+					// expired items.
+					if err != ErrNotFound {
+						return err
 					}
 				}
-			} else if onExpiredSync != nil {
-				for _, itm := range expired {
-					if err := onExpiredSync(itm.key, itm.val, tx); err != nil {
+				if onExpiry == nil && expiryC == nil {
+					continue
+				}
+				events = append(events, ev)
+				if outbox != "" {
+					key := outboxKey(outbox, ev)
+					_, _, err := tx.Set(key, ev.Value,
+						&SetOptions{Persist: true})
+					if err != nil {
 						return err
 					}
+					outboxKeys = append(outboxKeys, key)
 				}
 			}
-			return nil
-		})
-		if err == ErrDatabaseClosed {
-			break
+		} else if onExpiredSync != nil {
+			for _, itm := range expired {
+				if err := onExpiredSync(itm.key, itm.val, tx); err != nil {
+					return err
+				}
+			}
+		}
+		// only sweep again soon when items are actually being removed, or
+		// when the next items are yet to be reported.
+		more = limited && (db.exps.Len() < before || reporting)
+		if reporting && limited {
+			db.expnext = expired[len(expired)-1]
+		} else {
+			db.expnext = nil
 		}
+		db.expstats.Sweeps++
+		db.expstats.Expired += uint64(len(expired) - skipped)
+		if limited {
+			db.expstats.LimitedSweeps++
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	// the duration includes the commit, which writes the deletions to disk.
+	elapsed := time.Since(start)
+	db.mu.Lock()
+	db.expstats.LastSweep = elapsed
+	db.mu.Unlock()
 
-		// send expired event, if needed
-		if onExpired != nil && len(expired) > 0 {
-			keys := make([]string, 0, 32)
-			for _, itm := range expired {
-				keys = append(keys, itm.key)
+	// send expired event, if needed
+	if onExpired != nil && len(expired) > 0 {
+		keys := make([]string, 0, 32)
+		for _, itm := range expired {
+			keys = append(keys, itm.key)
+		}
+		onExpired(keys)
+	}
+
+	// deliver the expiry events, and then remove them from the outbox.
+	if len(events) > 0 {
+		n := db.deliverExpiry(events, onExpiry, expiryC, outbox != "")
+		if outbox != "" && n > 0 {
+			err := db.Update(func(tx *Tx) error {
+				for _, key := range outboxKeys[:n] {
+					if _, err := tx.Delete(key); err != nil &&
+						err != ErrNotFound {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return false, err
 			}
-			onExpired(keys)
+			// the outbox may hold more events that were not delivered.
+			more = more || outboxLimited
 		}
+	}
+	return more, nil
+}
 
-		// execute a disk sync, if needed
-		func() {
-			db.mu.Lock()
-			defer db.mu.Unlock()
-			if db.persist && db.config.SyncPolicy == EverySecond &&
-				flushes != db.flushes {
-				_ = db.file.Sync()
-				flushes = db.flushes
+// expiredItems returns up to max items that expired before the pivot, in the
+// order of expiration, starting after the from item, or at the first item
+// when from is nil. Zero means no limit. Returns true for limited when there
+// are more expired items that were left out.
+func (db *DB) expiredItems(from, pivot *dbItem, max int) (items []*dbItem,
+	limited bool,
+) {
+	iter := func(item interface{}) bool {
+		if item == from {
+			return true
+		}
+		if max > 0 && len(items) == max {
+			limited = true
+			return false
+		}
+		items = append(items, item.(*dbItem))
+		return true
+	}
+	if from == nil {
+		btreeAscendLessThan(db.exps, pivot, iter)
+	} else {
+		btreeAscendRange(db.exps, from, pivot, iter)
+	}
+	return items, limited
+}
+
+// deliverExpiry delivers the events, in order, to the function and then to
+// the channel. Returns the number of events that were delivered, which is
+// less than all of them when the database is closing, or when the function
+// returns an error and retry is set.
+func (db *DB) deliverExpiry(events []ExpiryEvent,
+	fn func(ev ExpiryEvent, tx *Tx) error, c chan<- ExpiryEvent, retry bool,
+) int {
+	for i, ev := range events {
+		if fn != nil {
+			if err := fn(ev, nil); err != nil && retry {
+				return i
 			}
-		}()
-		if shrink {
-			if err = db.Shrink(); err != nil {
-				if err == ErrDatabaseClosed {
-					break
-				}
+		}
+		if c != nil {
+			select {
+			case c <- ev:
+			case <-db.bgstop:
+				return i
+			}
+		}
+	}
+	return len(events)
+}
+
+// outboxKey returns the outbox key of an expiry event.
+func outboxKey(prefix string, ev ExpiryEvent) string {
+	return fmt.Sprintf("%s%020d.%09d:%s", prefix, ev.ExpiresAt.Unix(),
+		ev.ExpiresAt.Nanosecond(), ev.Key)
+}
+
+// outboxEvents returns up to max expiry events that are in the outbox,
+// ordered by expiration, along with their outbox keys. Zero means no limit.
+func (tx *Tx) outboxEvents(prefix string, max int) (events []ExpiryEvent,
+	keys []string,
+) {
+	btreeAscendGreaterOrEqual(tx.db.keys, &dbItem{key: prefix},
+		func(item interface{}) bool {
+			dbi := item.(*dbItem)
+			if !strings.HasPrefix(dbi.key, prefix) {
+				return false
+			}
+			if max > 0 && len(events) == max {
+				return false
 			}
+			rest := dbi.key[len(prefix):]
+			if len(rest) < 31 || rest[20] != '.' || rest[30] != ':' {
+				return true
+			}
+			sec, err := strconv.ParseInt(rest[:20], 10, 64)
+			if err != nil {
+				return true
+			}
+			nsec, err := strconv.ParseInt(rest[21:30], 10, 64)
+			if err != nil {
+				return true
+			}
+			events = append(events, ExpiryEvent{Key: rest[31:],
+				Value: dbi.val, ExpiresAt: time.Unix(sec, nsec)})
+			keys = append(keys, dbi.key)
+			return true
+		},
+	)
+	return events, keys
+}
+
+// SweepExpired removes all of the expired items from the database right away,
+// instead of waiting for the background process. The OnExpired and
+// OnExpiredSync callbacks are called as usual. This is mostly useful along
+// with a ManualClock.
+func (db *DB) SweepExpired() error {
+	for {
+		more, err := db.sweep()
+		if err != nil || !more {
+			return err
 		}
 	}
 }
 
+// ExpirationStats holds metrics about the removal of expired items by the
+// background process.
+type ExpirationStats struct {
+	// Backlog is the number of items that have expired but have not been
+	// removed yet.
+	Backlog int
+	// Sweeps is the number of sweeps for expired items.
+	Sweeps uint64
+	// LimitedSweeps is the number of sweeps that were cut short by the
+	// MaxExpirationsPerSweep limit.
+	LimitedSweeps uint64
+	// Expired is the number of expired items found by the sweeps.
+	Expired uint64
+	// LastSweep is how long the last sweep held the database lock, including
+	// writing the deletions to disk.
+	LastSweep time.Duration
+}
+
+// ExpirationStats returns metrics about the removal of expired items.
+func (db *DB) ExpirationStats() (ExpirationStats, error) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return ExpirationStats{}, ErrDatabaseClosed
+	}
+	stats := db.expstats
+	stats.Backlog = btreeCountLessThan(db.exps, &dbItem{
+		opts: &dbItemOpts{ex: true, exat: db.now()},
+	})
+	return stats, nil
+}
+
 // Shrink will make the database file smaller by removing redundant
 // log entries. This operation does not block the database.
 func (db *DB) Shrink() error {
@@ -664,6 +1380,8 @@ func (db *DB) Shrink() error {
 	if err != nil {
 		return err
 	}
+	// the sequence number belongs with the data prior to the endpos.
+	seq := db.seq
 	db.mu.Unlock()
 	time.Sleep(time.Second / 4) // wait just a bit before starting
 	f, err := os.Create(tmpname)
@@ -678,6 +1396,9 @@ func (db *DB) Shrink() error {
 	// we are going to read items in as chunks as to not hold up the database
 	// for too long.
 	var buf []byte
+	if seq > 0 {
+		buf = appendSeq(buf, seq)
+	}
 	pivot := ""
 	done := false
 	for !done {
@@ -689,7 +1410,7 @@ func (db *DB) Shrink() error {
 			}
 			done = true
 			var n int
-			now := time.Now()
+			now := db.now()
 			btreeAscendGreaterOrEqual(db.keys, &dbItem{key: pivot},
 				func(item interface{}) bool {
 					dbi := item.(*dbItem)
@@ -788,7 +1509,7 @@ func renameFile(src, dest string) error {
 
 // readLoad reads from the reader and loads commands into the database.
 // modTime is the modified time of the reader, should be no greater than
-// the current time.Now().
+// the current time of the database clock.
 // Returns the number of bytes of the last command read and the error if any.
 func (db *DB) readLoad(rd io.Reader, modTime time.Time) (n int64, err error) {
 	defer func() {
@@ -906,12 +1627,24 @@ func (db *DB) readLoad(rd io.Reader, modTime time.Time) (n int64, err error) {
 			(parts[0][1] == 'e' || parts[0][1] == 'E') &&
 			(parts[0][2] == 't' || parts[0][2] == 'T') {
 			// SET
-			if len(parts) < 3 || len(parts) == 4 || len(parts) > 5 {
+			if len(parts) < 3 || len(parts) == 4 || len(parts) == 6 ||
+				len(parts) > 7 {
 				return totalSize, ErrInvalid
 			}
-			if len(parts) == 5 {
+			var slide time.Duration
+			if len(parts) == 7 {
+				if strings.ToLower(parts[5]) != "sliding" {
+					return totalSize, ErrInvalid
+				}
+				ms, err := strconv.ParseInt(parts[6], 10, 64)
+				if err != nil {
+					return totalSize, err
+				}
+				slide = time.Duration(ms) * time.Millisecond
+			}
+			if len(parts) >= 5 {
 				arg := strings.ToLower(parts[3])
-				if arg != "ex" && arg != "ae" {
+				if arg != "ex" && arg != "ae" && arg != "px" && arg != "pxat" {
 					return totalSize, ErrInvalid
 				}
 				ex, err := strconv.ParseInt(parts[4], 10, 64)
@@ -919,20 +1652,28 @@ func (db *DB) readLoad(rd io.Reader, modTime time.Time) (n int64, err error) {
 					return totalSize, err
 				}
 				var exat time.Time
-				now := time.Now()
-				if arg == "ex" {
+				now := db.now()
+				switch arg {
+				case "ex":
 					dur := (time.Duration(ex) * time.Second) - now.Sub(modTime)
 					exat = now.Add(dur)
-				} else {
+				case "px":
+					dur := (time.Duration(ex) * time.Millisecond) -
+						now.Sub(modTime)
+					exat = now.Add(dur)
+				case "ae":
 					exat = time.Unix(ex, 0)
+				default:
+					exat = time.UnixMilli(ex)
 				}
 				if exat.After(now) {
 					db.insertIntoDatabase(&dbItem{
 						key: parts[1],
 						val: parts[2],
 						opts: &dbItemOpts{
-							ex:   true,
-							exat: exat,
+							ex:    true,
+							exat:  exat,
+							slide: slide,
 						},
 					})
 				} else {
@@ -951,22 +1692,65 @@ func (db *DB) readLoad(rd io.Reader, modTime time.Time) (n int64, err error) {
 				return totalSize, ErrInvalid
 			}
 			db.deleteFromDatabase(&dbItem{key: parts[1]})
-		} else if (parts[0][0] == 'f' || parts[0][0] == 'F') &&
-			strings.ToLower(parts[0]) == "flushdb" {
-			db.keys = btreeNew(lessCtx(nil))
-			db.exps = btreeNew(lessCtx(&exctx{db}))
-			db.idxs = make(map[string]*index)
-		} else {
-			return totalSize, ErrInvalid
-		}
-		totalSize += cmdByteSize
-	}
-}
-
-// load reads entries from the append only database file and fills the database.
-// The file format uses the Redis append only file format, which is and a series
-// of RESP commands. For more information on RESP please read
-// http://redis.io/topics/protocol. The only supported RESP commands are DEL and
+		} else if strings.ToLower(parts[0]) == "pexpireat" {
+			// PEXPIREAT
+			if len(parts) != 3 {
+				return totalSize, ErrInvalid
+			}
+			ex, err := strconv.ParseInt(parts[2], 10, 64)
+			if err != nil {
+				return totalSize, err
+			}
+			if item := db.get(parts[1]); item != nil {
+				exat := time.UnixMilli(ex)
+				if exat.After(db.now()) {
+					opts := &dbItemOpts{ex: true, exat: exat}
+					if item.opts != nil {
+						opts.slide = item.opts.slide
+					}
+					db.insertIntoDatabase(&dbItem{
+						key:  item.key,
+						val:  item.val,
+						opts: opts,
+					})
+				} else {
+					db.deleteFromDatabase(&dbItem{key: item.key})
+				}
+			}
+		} else if strings.ToLower(parts[0]) == "persist" {
+			// PERSIST
+			if len(parts) != 2 {
+				return totalSize, ErrInvalid
+			}
+			if item := db.get(parts[1]); item != nil {
+				db.insertIntoDatabase(&dbItem{key: item.key, val: item.val})
+			}
+		} else if strings.ToLower(parts[0]) == "seq" {
+			// SEQ
+			if len(parts) != 2 {
+				return totalSize, ErrInvalid
+			}
+			seq, err := strconv.ParseUint(parts[1], 10, 64)
+			if err != nil {
+				return totalSize, err
+			}
+			db.seq = seq
+		} else if (parts[0][0] == 'f' || parts[0][0] == 'F') &&
+			strings.ToLower(parts[0]) == "flushdb" {
+			db.keys = btreeNew(lessCtx(nil))
+			db.exps = btreeNew(lessCtx(&exctx{db}))
+			db.idxs = make(map[string]*index)
+		} else {
+			return totalSize, ErrInvalid
+		}
+		totalSize += cmdByteSize
+	}
+}
+
+// load reads entries from the append only database file and fills the database.
+// The file format uses the Redis append only file format, which is and a series
+// of RESP commands. For more information on RESP please read
+// http://redis.io/topics/protocol. The only supported RESP commands are DEL and
 // SET.
 func (db *DB) load() error {
 	fi, err := db.file.Stat()
@@ -1007,6 +1791,13 @@ func (db *DB) managed(writable bool, fn func(tx *Tx) error) (err error) {
 	if err != nil {
 		return
 	}
+	return tx.managed(fn)
+}
+
+// managed calls a block of code inside of an already opened transaction, and
+// then commits or rolls back the transaction upon completion.
+func (tx *Tx) managed(fn func(tx *Tx) error) (err error) {
+	writable := tx.writable
 	defer func() {
 		if err != nil {
 			// The caller returned an error. We must rollback.
@@ -1039,6 +1830,32 @@ func (db *DB) View(fn func(tx *Tx) error) error {
 	return db.managed(false, fn)
 }
 
+// UpdateOptimistic executes a function within a managed optimistic read/write
+// transaction.
+// See BeginOptimistic for more information.
+func (db *DB) UpdateOptimistic(fn func(tx *Tx) error) error {
+	tx, err := db.BeginOptimistic()
+	if err != nil {
+		return err
+	}
+	return tx.managed(fn)
+}
+
+// UpdateRetry executes a function within a managed optimistic read/write
+// transaction, and runs the function again in a new transaction each time
+// that the commit fails with ErrConflict. The function is called no more
+// than maxAttempts times, and the ErrConflict of the last attempt is
+// returned when all attempts fail.
+// If maxAttempts is less than one then only one attempt is made.
+func (db *DB) UpdateRetry(fn func(tx *Tx) error, maxAttempts int) error {
+	for i := 1; ; i++ {
+		err := db.UpdateOptimistic(fn)
+		if err != ErrConflict || i >= maxAttempts {
+			return err
+		}
+	}
+}
+
 // Update executes a function within a managed read/write transaction.
 // The transaction has been committed when no error is returned.
 // In the event that an error is returned, the transaction will be rolled back.
@@ -1051,6 +1868,40 @@ func (db *DB) Update(fn func(tx *Tx) error) error {
 	return db.managed(true, fn)
 }
 
+// ViewContext is the same as View except that it gives up waiting for the
+// transaction to begin when the context is done. The context is also bound
+// to the transaction. See BeginContext for more information.
+func (db *DB) ViewContext(ctx context.Context, fn func(tx *Tx) error) error {
+	tx, err := db.BeginContext(ctx, false)
+	if err != nil {
+		return err
+	}
+	return tx.managed(fn)
+}
+
+// UpdateContext is the same as Update except that it gives up waiting for
+// the transaction to begin when the context is done. The context is also
+// bound to the transaction. See BeginContext for more information.
+func (db *DB) UpdateContext(ctx context.Context,
+	fn func(tx *Tx) error) error {
+	tx, err := db.BeginContext(ctx, true)
+	if err != nil {
+		return err
+	}
+	return tx.managed(fn)
+}
+
+// ViewSnapshot executes a function within a managed read-only transaction
+// that operates on a point-in-time snapshot of the database.
+// See BeginSnapshot for more information.
+func (db *DB) ViewSnapshot(fn func(tx *Tx) error) error {
+	tx, err := db.BeginSnapshot()
+	if err != nil {
+		return err
+	}
+	return tx.managed(fn)
+}
+
 // get return an item or nil if not found.
 func (db *DB) get(key string) *dbItem {
 	item := db.keys.Get(&dbItem{key: key})
@@ -1070,7 +1921,37 @@ type Tx struct {
 	db       *DB             // the underlying database.
 	writable bool            // when false mutable operations fail.
 	funcd    bool            // when true Commit and Rollback panic.
+	snapshot bool            // when true the tx does not hold a lock.
 	wc       *txWriteContext // context for writable transactions.
+	occ      *txOptimistic   // context for optimistic transactions.
+	ctx      context.Context // context for canceling iterations, if any.
+}
+
+// txOptimistic tracks what an optimistic transaction depends on.
+type txOptimistic struct {
+	db      *DB                // the origin database.
+	commits uint64             // the origin commit count at begin.
+	vers    uint64             // the origin version at begin.
+	seen    map[string]*dbItem // the items of every key read or written.
+	scanned bool               // set when a range of items was read.
+}
+
+// observe records the current item for a key, unless the key has already
+// been observed. This must be called before the key is changed by the tx.
+func (tx *Tx) observe(key string) {
+	if tx.occ == nil {
+		return
+	}
+	if _, ok := tx.occ.seen[key]; !ok {
+		tx.occ.seen[key] = tx.db.get(key)
+	}
+}
+
+// observeScan records that the transaction read a range of items.
+func (tx *Tx) observeScan() {
+	if tx.occ != nil {
+		tx.occ.scanned = true
+	}
 }
 
 type txWriteContext struct {
@@ -1081,8 +1962,244 @@ type txWriteContext struct {
 
 	rollbackItems   map[string]*dbItem // details for rolling back tx.
 	commitItems     map[string]*dbItem // details for committing tx.
+	record          bool               // the commit items are needed.
+	changed         bool               // a key was set or deleted.
 	itercount       int                // stack of iterators
+	pending         map[string]*dbItem // mutations deferred by iterators.
 	rollbackIndexes map[string]*index  // details for dropped indexes.
+	savepoints      []*Savepoint       // stack of active savepoints.
+	expired         map[string]bool    // keys removed for being expired.
+	ttlonly         map[string]bool    // keys with only a changed ttl.
+}
+
+// Savepoint marks a point in a read/write transaction that the transaction
+// can be partially rolled back to. See Tx.Savepoint for more information.
+type Savepoint struct {
+	items       map[string]*dbItem    // items as they were at the savepoint.
+	changed     bool                  // the tx had changed keys.
+	commits     map[string]commitUndo // commit entries as they were.
+	indexes     map[string]*index     // indexes as they were, nil if missing.
+	rbkeys      *btree.BTree          // the tx deleteAll state at the savepoint.
+	rbexps      *btree.BTree          // ..
+	rbidxs      map[string]*index     // ..
+	flushed     bool                  // a deleteAll happened after savepoint.
+	keys        *btree.BTree          // trees from before the deleteAll.
+	exps        *btree.BTree          // ..
+	idxs        map[string]*index     // ..
+	commitItems map[string]*dbItem    // commit entries from before deleteAll.
+}
+
+// commitUndo holds a commit entry for a key, which may not exist.
+type commitUndo struct {
+	item *dbItem
+	ok   bool
+}
+
+// newSavepoint returns a savepoint for the current state of the transaction.
+func (wc *txWriteContext) newSavepoint() *Savepoint {
+	return &Savepoint{
+		items:   make(map[string]*dbItem),
+		changed: wc.changed,
+		commits: make(map[string]commitUndo),
+		indexes: make(map[string]*index),
+		rbkeys:  wc.rbkeys,
+		rbexps:  wc.rbexps,
+		rbidxs:  wc.rbidxs,
+	}
+}
+
+// savepoint returns the innermost savepoint that is still recording
+// changes, or nil if there is none.
+func (wc *txWriteContext) savepoint() *Savepoint {
+	if len(wc.savepoints) == 0 {
+		return nil
+	}
+	sp := wc.savepoints[len(wc.savepoints)-1]
+	if sp.flushed {
+		// everything that happens after a deleteAll is undone by
+		// restoring the trees from before the deleteAll.
+		return nil
+	}
+	return sp
+}
+
+// saveItem records the state of a key before it is changed by the tx.
+func (tx *Tx) saveItem(key string) {
+	sp := tx.wc.savepoint()
+	if sp == nil {
+		return
+	}
+	if _, ok := sp.items[key]; !ok {
+		sp.items[key] = tx.db.get(key)
+	}
+	if _, ok := sp.commits[key]; !ok {
+		item, ok := tx.wc.commitItems[key]
+		sp.commits[key] = commitUndo{item, ok}
+	}
+}
+
+// saveIndex records the state of an index before it is changed by the tx.
+func (tx *Tx) saveIndex(name string) {
+	sp := tx.wc.savepoint()
+	if sp == nil {
+		return
+	}
+	if _, ok := sp.indexes[name]; !ok {
+		sp.indexes[name] = tx.db.idxs[name]
+	}
+}
+
+// Savepoint creates a new savepoint in the transaction. The changes that
+// follow the savepoint can be undone with RollbackTo() without rolling back
+// the entire transaction, or they can be kept with Release().
+// Savepoints can be nested, and the same savepoint can be rolled back to any
+// number of times until it is released.
+//
+// Only a writable transaction can be used with this operation.
+// This operation is not allowed during iterations such as Ascend* & Descend*.
+func (tx *Tx) Savepoint() (*Savepoint, error) {
+	if tx.db == nil {
+		return nil, ErrTxClosed
+	} else if !tx.writable {
+		return nil, ErrTxNotWritable
+	} else if tx.wc.itercount > 0 {
+		return nil, ErrTxIterating
+	}
+	sp := tx.wc.newSavepoint()
+	tx.wc.savepoints = append(tx.wc.savepoints, sp)
+	return sp, nil
+}
+
+// findSavepoint returns the position of a savepoint in the stack of active
+// savepoints, or -1 when it's not active.
+func (tx *Tx) findSavepoint(sp *Savepoint) int {
+	for i := len(tx.wc.savepoints) - 1; i >= 0; i-- {
+		if tx.wc.savepoints[i] == sp {
+			return i
+		}
+	}
+	return -1
+}
+
+// RollbackTo reverts all changes that were performed on the transaction
+// since the savepoint was created, including the changes to indexes and the
+// effects of DeleteAll. Savepoints that were created after sp are released.
+// The sp savepoint remains active.
+//
+// An ErrInvalidOperation is returned when the savepoint is not active in
+// this transaction.
+func (tx *Tx) RollbackTo(sp *Savepoint) error {
+	if tx.db == nil {
+		return ErrTxClosed
+	} else if !tx.writable {
+		return ErrTxNotWritable
+	} else if tx.wc.itercount > 0 {
+		return ErrTxIterating
+	}
+	i := tx.findSavepoint(sp)
+	if i == -1 {
+		return ErrInvalidOperation
+	}
+	for j := len(tx.wc.savepoints) - 1; j >= i; j-- {
+		tx.undoSavepoint(tx.wc.savepoints[j])
+		tx.wc.savepoints[j] = nil
+	}
+	// start recording again for the savepoint.
+	tx.wc.savepoints[i] = sp
+	*sp = *tx.wc.newSavepoint()
+	tx.wc.savepoints = tx.wc.savepoints[:i+1]
+	return nil
+}
+
+// undoSavepoint reverts the changes that were recorded by the savepoint.
+func (tx *Tx) undoSavepoint(sp *Savepoint) {
+	if sp.flushed {
+		// rollback the deleteAll
+		tx.db.keys = sp.keys
+		tx.db.exps = sp.exps
+		tx.db.idxs = sp.idxs
+		tx.wc.commitItems = sp.commitItems
+	}
+	tx.wc.rbkeys = sp.rbkeys
+	tx.wc.rbexps = sp.rbexps
+	tx.wc.rbidxs = sp.rbidxs
+	tx.wc.changed = sp.changed
+	for key, item := range sp.items {
+		tx.db.deleteFromDatabase(&dbItem{key: key})
+		if item != nil {
+			tx.db.insertIntoDatabase(item)
+		}
+	}
+	for key, c := range sp.commits {
+		if c.ok {
+			tx.wc.recordCommit(key, c.item)
+		} else {
+			delete(tx.wc.commitItems, key)
+		}
+	}
+	for name, idx := range sp.indexes {
+		delete(tx.db.idxs, name)
+		if idx != nil {
+			// The index may have missed changes while it was dropped.
+			tx.db.idxs[name] = idx
+			idx.rebuild()
+		}
+	}
+}
+
+// Release removes the savepoint, and all savepoints that were created after
+// it, while keeping their changes. The changes can still be undone by rolling
+// back to an outer savepoint or by rolling back the transaction.
+//
+// An ErrInvalidOperation is returned when the savepoint is not active in
+// this transaction.
+func (tx *Tx) Release(sp *Savepoint) error {
+	if tx.db == nil {
+		return ErrTxClosed
+	} else if !tx.writable {
+		return ErrTxNotWritable
+	}
+	i := tx.findSavepoint(sp)
+	if i == -1 {
+		return ErrInvalidOperation
+	}
+	for j := len(tx.wc.savepoints) - 1; j >= i; j-- {
+		if j > 0 {
+			tx.wc.savepoints[j-1].merge(tx.wc.savepoints[j])
+		}
+		tx.wc.savepoints[j] = nil
+	}
+	tx.wc.savepoints = tx.wc.savepoints[:i]
+	return nil
+}
+
+// merge moves the undo information of an inner savepoint into its parent.
+func (sp *Savepoint) merge(inner *Savepoint) {
+	if sp.flushed {
+		// the parent will restore the trees from before its own deleteAll,
+		// which happened before the inner savepoint.
+		return
+	}
+	for key, item := range inner.items {
+		if _, ok := sp.items[key]; !ok {
+			sp.items[key] = item
+		}
+	}
+	for key, c := range inner.commits {
+		if _, ok := sp.commits[key]; !ok {
+			sp.commits[key] = c
+		}
+	}
+	for name, idx := range inner.indexes {
+		if _, ok := sp.indexes[name]; !ok {
+			sp.indexes[name] = idx
+		}
+	}
+	if inner.flushed {
+		sp.flushed = true
+		sp.keys, sp.exps, sp.idxs = inner.keys, inner.exps, inner.idxs
+		sp.commitItems = inner.commitItems
+	}
 }
 
 // DeleteAll deletes all items from the database.
@@ -1093,6 +2210,15 @@ func (tx *Tx) DeleteAll() error {
 		return ErrTxNotWritable
 	} else if tx.wc.itercount > 0 {
 		return ErrTxIterating
+	} else if tx.occ != nil {
+		return ErrInvalidOperation
+	}
+
+	if sp := tx.wc.savepoint(); sp != nil {
+		// the savepoint needs the trees from before the deleteAll.
+		sp.flushed = true
+		sp.keys, sp.exps, sp.idxs = tx.db.keys, tx.db.exps, tx.db.idxs
+		sp.commitItems = tx.wc.commitItems
 	}
 
 	// check to see if we've already deleted everything
@@ -1103,6 +2229,9 @@ func (tx *Tx) DeleteAll() error {
 		tx.wc.rbidxs = tx.db.idxs
 	}
 
+	// every key is deleted
+	tx.db.flushver = tx.db.vers
+
 	// now reset the live database trees
 	tx.db.keys = btreeNew(lessCtx(nil))
 	tx.db.exps = btreeNew(lessCtx(&exctx{tx.db}))
@@ -1114,7 +2243,9 @@ func (tx *Tx) DeleteAll() error {
 	}
 
 	// always clear out the commits
-	tx.wc.commitItems = make(map[string]*dbItem)
+	tx.wc.commitItems = nil
+	tx.wc.ttlonly = nil
+	tx.wc.changed = true
 
 	return nil
 }
@@ -1127,140 +2258,960 @@ func (tx *Tx) DeleteAll() error {
 //
 // All transactions must be closed by calling Commit() or Rollback() when done.
 func (db *DB) Begin(writable bool) (*Tx, error) {
+	return db.BeginContext(context.Background(), writable)
+}
+
+// BeginContext is the same as Begin except that it gives up waiting for the
+// database lock when the context is done, in which case the context error is
+// returned.
+//
+// The context is also bound to the transaction. Iterating with the Ascend*,
+// Descend*, Intersects, and Nearby methods will stop and return the context
+// error when the context is done before the iteration has completed.
+func (db *DB) BeginContext(ctx context.Context, writable bool) (*Tx, error) {
 	tx := &Tx{
 		db:       db,
 		writable: writable,
 	}
-	tx.lock()
+	if ctx.Done() != nil {
+		// a context that can never be canceled is not checked while
+		// iterating.
+		tx.ctx = ctx
+	}
+	if err := db.trackTx(); err != nil {
+		return nil, err
+	}
+	if !writable {
+		// the read lock cannot apply the queued touches.
+		db.landTouches()
+	}
+	if err := tx.lockContext(ctx); err != nil {
+		db.untrackTx()
+		return nil, err
+	}
 	if db.closed {
 		tx.unlock()
+		db.untrackTx()
 		return nil, ErrDatabaseClosed
 	}
 	if writable {
+		// apply the queued touches before the transaction reads anything.
+		_ = db.applyTouches()
 		// writable transactions have a writeContext object that
 		// contains information about changes to the database.
-		tx.wc = &txWriteContext{}
-		tx.wc.rollbackItems = make(map[string]*dbItem)
-		tx.wc.rollbackIndexes = make(map[string]*index)
-		if db.persist {
-			tx.wc.commitItems = make(map[string]*dbItem)
-		}
+		tx.wc = newTxWriteContext(db.recordsCommits())
 	}
 	return tx, nil
 }
 
-// lock locks the database based on the transaction type.
-func (tx *Tx) lock() {
-	if tx.writable {
-		tx.db.mu.Lock()
-	} else {
-		tx.db.mu.RLock()
+// newTxWriteContext returns an empty context for a writable transaction.
+// The changed items are only recorded for the commit when record is set.
+func newTxWriteContext(record bool) *txWriteContext {
+	return &txWriteContext{
+		rollbackItems:   make(map[string]*dbItem),
+		rollbackIndexes: make(map[string]*index),
+		record:          record,
 	}
 }
 
-// unlock unlocks the database based on the transaction type.
-func (tx *Tx) unlock() {
-	if tx.writable {
-		tx.db.mu.Unlock()
-	} else {
-		tx.db.mu.RUnlock()
+// recordCommit records the item of a key for the commit, where a nil item
+// means that the key is deleted. Nothing is recorded when the commit items
+// are not needed.
+func (wc *txWriteContext) recordCommit(key string, item *dbItem) {
+	if !wc.record {
+		return
 	}
+	if wc.commitItems == nil {
+		wc.commitItems = make(map[string]*dbItem)
+	}
+	wc.commitItems[key] = item
 }
 
-// rollbackInner handles the underlying rollback logic.
-// Intended to be called from Commit() and Rollback().
-func (tx *Tx) rollbackInner() {
-	// rollback the deleteAll if needed
-	if tx.wc.rbkeys != nil {
-		tx.db.keys = tx.wc.rbkeys
-		tx.db.idxs = tx.wc.rbidxs
-		tx.db.exps = tx.wc.rbexps
+// recordsCommits returns true when the commits need the changed items, in
+// order to write them to disk, or to report them as changes.
+// This must be called while holding the database lock.
+func (db *DB) recordsCommits() bool {
+	return db.persist || db.config.OnCommit != nil ||
+		db.config.ChangeRetention > 0 || db.notifiers.active()
+}
+
+// BeginOptimistic opens a new optimistic read/write transaction.
+// Any number of optimistic transactions can be opened at the same time, and
+// like a snapshot transaction, an optimistic transaction does not hold a lock
+// on the database while it's open. All reads come from a point-in-time
+// snapshot of the database, and all changes are kept private to the
+// transaction until it's committed.
+//
+// The transaction keeps track of every key that it reads or writes. Upon
+// Commit() those keys are validated against the database, and if any of
+// them were changed by another transaction in the meantime, the commit fails
+// with ErrConflict and none of the changes are applied. Iterating over a
+// range of items with Ascend*, Descend*, Intersects, Nearby, or Len makes the
+// transaction depend on the entire database. Such a transaction fails to
+// commit if any other transaction changed any data in the meantime.
+//
+// Optimistic transactions cannot create or drop indexes, or call DeleteAll.
+// Those operations return ErrInvalidOperation.
+//
+// All transactions must be closed by calling Commit() or Rollback() when done.
+func (db *DB) BeginOptimistic() (*Tx, error) {
+	if db.isClosing() {
+		// the lock may be held by the open transactions.
+		return nil, ErrDatabaseClosed
 	}
-	for key, item := range tx.wc.rollbackItems {
-		tx.db.deleteFromDatabase(&dbItem{key: key})
-		if item != nil {
-			// When an item is not nil, we will need to reinsert that item
-			// into the database overwriting the current one.
-			tx.db.insertIntoDatabase(item)
+	db.landTouches()
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return nil, ErrDatabaseClosed
+	}
+	return &Tx{
+		db:       db.snapshot(),
+		writable: true,
+		snapshot: true,
+		wc:       newTxWriteContext(true), // the commit replays the items.
+		occ: &txOptimistic{
+			db:      db,
+			commits: db.commits,
+			vers:    db.vers,
+			seen:    make(map[string]*dbItem),
+		},
+	}, nil
+}
+
+// commitOptimistic validates the changes of an optimistic transaction and
+// applies them to the origin database.
+func (tx *Tx) commitOptimistic() error {
+	db := tx.occ.db
+	if err := db.trackTx(); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		db.untrackTx()
+		return ErrDatabaseClosed
+	}
+	conflict := tx.occ.scanned && db.commits != tx.occ.commits
+	for key, item := range tx.occ.seen {
+		if conflict {
+			break
 		}
+		// Items are never changed in place, so any change to the key will
+		// have replaced the item.
+		cur := db.get(key)
+		conflict = cur.version() != item.version() ||
+			(cur == nil && db.deletedSince(key, tx.occ.vers))
 	}
-	for name, idx := range tx.wc.rollbackIndexes {
-		delete(tx.db.idxs, name)
-		if idx != nil {
-			// When an index is not nil, we will need to rebuilt that index
-			// this could be an expensive process if the database has many
-			// items or the index is complex.
-			tx.db.idxs[name] = idx
-			idx.rebuild()
+	if conflict {
+		db.mu.Unlock()
+		db.untrackTx()
+		return ErrConflict
+	}
+	// Replay the changes in a writable transaction that takes over the lock.
+	ltx := &Tx{db: db, writable: true,
+		wc: newTxWriteContext(db.recordsCommits())}
+	for key, item := range tx.wc.commitItems {
+		if item == nil {
+			ltx.deleteItem(key)
+		} else {
+			ltx.setItem(item)
 		}
 	}
+	return ltx.Commit()
 }
 
-// Commit writes all changes to disk.
-// An error is returned when a write error occurs, or when a Commit() is called
-// from a read-only transaction.
-func (tx *Tx) Commit() error {
-	if tx.funcd {
-		panic("managed tx commit not allowed")
-	}
-	if tx.db == nil {
-		return ErrTxClosed
-	} else if !tx.writable {
-		return ErrTxNotWritable
+// BeginSnapshot opens a new read-only transaction on a point-in-time
+// snapshot of the database.
+// Unlike a transaction opened with Begin(false), a snapshot transaction does
+// not hold a lock on the database while it's open. Writable transactions and
+// the background expiration of items will continue to commit as usual, and
+// none of those changes will be visible to the snapshot.
+//
+// Taking a snapshot is cheap because the underlying b-trees are shared
+// copy-on-write. The spatial indexes cannot be shared and are built from
+// the snapshot the first time that Intersects or Nearby is used on them.
+//
+// All transactions must be closed by calling Rollback() when done.
+func (db *DB) BeginSnapshot() (*Tx, error) {
+	if db.isClosing() {
+		// the lock may be held by the open transactions.
+		return nil, ErrDatabaseClosed
 	}
-	var err error
-	if tx.db.persist && (len(tx.wc.commitItems) > 0 || tx.wc.rbkeys != nil) {
-		tx.db.buf = tx.db.buf[:0]
+	db.landTouches()
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return nil, ErrDatabaseClosed
+	}
+	return &Tx{db: db.snapshot(), snapshot: true}, nil
+}
+
+// snapshot returns a detached copy of the database that shares its trees
+// copy-on-write. The caller must hold at least a read lock.
+func (db *DB) snapshot() *DB {
+	// Copying a b-tree resets the copy-on-write state of the source tree,
+	// so two readers must not copy at the same time.
+	db.snapmu.Lock()
+	defer db.snapmu.Unlock()
+	snap := &DB{
+		keys:   db.keys.Copy(),
+		exps:   db.exps.Copy(),
+		idxs:   make(map[string]*index, len(db.idxs)),
+		config: db.config,
+		seq:    db.seq,
+		vers:   db.vers,
+	}
+	for name, idx := range db.idxs {
+		sidx := &index{
+			name:    idx.name,
+			pattern: idx.pattern,
+			less:    idx.less,
+			rect:    idx.rect,
+			fields:  idx.fields,
+			db:      snap,
+			opts:    idx.opts,
+		}
+		if idx.btr != nil {
+			sidx.btr = idx.btr.Copy()
+		}
+		snap.idxs[name] = sidx
+	}
+	return snap
+}
+
+// lock locks the database based on the transaction type.
+func (tx *Tx) lock() {
+	if tx.snapshot {
+		return
+	}
+	if tx.writable {
+		tx.db.mu.Lock()
+	} else {
+		tx.db.mu.RLock()
+	}
+}
+
+// tryLock attempts to lock the database based on the transaction type
+// without blocking.
+func (tx *Tx) tryLock() bool {
+	if tx.writable {
+		return tx.db.mu.TryLock()
+	}
+	return tx.db.mu.TryRLock()
+}
+
+// lockContext locks the database based on the transaction type, but gives
+// up waiting when the context is done.
+func (tx *Tx) lockContext(ctx context.Context) error {
+	if ctx.Done() == nil {
+		// the context can never be canceled.
+		tx.lock()
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if tx.tryLock() {
+		return nil
+	}
+	// A sync.RWMutex cannot be canceled, so the waiting is done by another
+	// goroutine that hands the lock over when it's acquired.
+	locked := make(chan struct{})
+	go func() {
+		tx.lock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		return nil
+	case <-ctx.Done():
+		// The goroutine will eventually acquire the lock, which must then
+		// be released for everyone else.
+		go func() {
+			<-locked
+			tx.unlock()
+		}()
+		return ctx.Err()
+	}
+}
+
+// canceled returns true when an iteration must stop because the context of
+// the transaction is done, or because the database is closing.
+func (tx *Tx) canceled() bool {
+	if tx.ctx != nil {
+		select {
+		case <-tx.ctx.Done():
+			return true
+		default:
+		}
+	}
+	return atomic.LoadInt32(&tx.db.aborted) != 0
+}
+
+// canceledErr returns the reason that an iteration was canceled.
+func (tx *Tx) canceledErr() error {
+	if atomic.LoadInt32(&tx.db.aborted) != 0 {
+		return ErrDatabaseClosed
+	}
+	return tx.ctx.Err()
+}
+
+// unlock unlocks the database based on the transaction type.
+func (tx *Tx) unlock() {
+	if tx.snapshot {
+		return
+	}
+	if tx.writable {
+		tx.db.mu.Unlock()
+	} else {
+		tx.db.mu.RUnlock()
+	}
+}
+
+// rollbackInner handles the underlying rollback logic.
+// Intended to be called from Commit() and Rollback().
+func (tx *Tx) rollbackInner() {
+	// rollback the deleteAll if needed
+	if tx.wc.rbkeys != nil {
+		tx.db.keys = tx.wc.rbkeys
+		tx.db.idxs = tx.wc.rbidxs
+		tx.db.exps = tx.wc.rbexps
+	}
+	for key, item := range tx.wc.rollbackItems {
+		tx.db.deleteFromDatabase(&dbItem{key: key})
+		if item != nil {
+			// When an item is not nil, we will need to reinsert that item
+			// into the database overwriting the current one.
+			tx.db.insertIntoDatabase(item)
+		}
+	}
+	for name, idx := range tx.wc.rollbackIndexes {
+		delete(tx.db.idxs, name)
+		if idx != nil {
+			// When an index is not nil, we will need to rebuilt that index
+			// this could be an expensive process if the database has many
+			// items or the index is complex.
+			tx.db.idxs[name] = idx
+			idx.rebuild()
+		}
+	}
+}
+
+// Commit writes all changes to disk.
+// An error is returned when a write error occurs, or when a Commit() is called
+// from a read-only transaction.
+func (tx *Tx) Commit() error {
+	if tx.funcd {
+		panic("managed tx commit not allowed")
+	}
+	if tx.db == nil {
+		return ErrTxClosed
+	} else if !tx.writable {
+		return ErrTxNotWritable
+	}
+	// Apply the mutations that are still deferred by iterators or cursors
+	// that were not closed.
+	if tx.wc.pending != nil {
+		tx.applyPending()
+	}
+	if tx.occ != nil {
+		err := tx.commitOptimistic()
+		// Clear the db field to disable this transaction from future use.
+		tx.db = nil
+		return err
+	}
+	var err error
+	changed := tx.wc.changed
+	if tx.db.persist && changed {
+		tx.db.buf = tx.db.buf[:0]
 		// write a flushdb if a deleteAll was called.
 		if tx.wc.rbkeys != nil {
 			tx.db.buf = append(tx.db.buf, "*1\r\n$7\r\nflushdb\r\n"...)
 		}
-		now := time.Now()
+		now := tx.db.now()
 		// Each committed record is written to disk
 		for key, item := range tx.wc.commitItems {
 			if item == nil {
 				tx.db.buf = (&dbItem{key: key}).writeDeleteTo(tx.db.buf)
+			} else if tx.wc.ttlonly[key] {
+				tx.db.buf = item.writeExpireTo(tx.db.buf)
 			} else {
 				tx.db.buf = item.writeSetTo(tx.db.buf, now)
 			}
 		}
+		if tx.db.config.ChangeRetention > 0 {
+			tx.db.buf = appendSeq(tx.db.buf, tx.db.seq+1)
+		}
 		// Flushing the buffer only once per transaction.
 		// If this operation fails then the write did failed and we must
 		// rollback.
-		var n int
-		n, err = tx.db.file.Write(tx.db.buf)
-		if err != nil {
-			if n > 0 {
-				// There was a partial write to disk.
-				// We are possibly out of disk space.
-				// Delete the partially written bytes from the data file by
-				// seeking to the previously known position and performing
-				// a truncate operation.
-				// At this point a syscall failure is fatal and the process
-				// should be killed to avoid corrupting the file.
-				pos, err := tx.db.file.Seek(-int64(n), 1)
-				if err != nil {
-					panicErr(err)
-				}
-				if err := tx.db.file.Truncate(pos); err != nil {
-					panicErr(err)
-				}
-			}
+		if err = tx.db.flush(); err != nil {
 			tx.rollbackInner()
 		}
-		if tx.db.config.SyncPolicy == Always {
-			_ = tx.db.file.Sync()
-		}
-		// Increment the number of flushes. The background syncing uses this.
-		tx.db.flushes++
+	}
+	var changes []Change
+	onCommit := tx.db.config.OnCommit
+	if changed && err == nil {
+		changes = tx.db.committed(tx.changes)
 	}
 	// Unlock the database and allow for another writable transaction.
 	tx.unlock()
+	tx.untrack()
 	// Clear the db field to disable this transaction from future use.
 	tx.db = nil
+	if onCommit != nil && len(changes) > 0 {
+		onCommit(changes)
+	}
 	return err
 }
 
+// flush writes the buffer to the file. A failed write leaves the file as it
+// was prior to the flush.
+// This must be called while holding the database lock.
+func (db *DB) flush() error {
+	n, err := db.file.Write(db.buf)
+	if err != nil {
+		if n > 0 {
+			// There was a partial write to disk.
+			// We are possibly out of disk space.
+			// Delete the partially written bytes from the data file by
+			// seeking to the previously known position and performing
+			// a truncate operation.
+			// At this point a syscall failure is fatal and the process
+			// should be killed to avoid corrupting the file.
+			pos, err := db.file.Seek(-int64(n), 1)
+			if err != nil {
+				panicErr(err)
+			}
+			if err := db.file.Truncate(pos); err != nil {
+				panicErr(err)
+			}
+		}
+	}
+	if db.config.SyncPolicy == Always {
+		_ = db.file.Sync()
+	}
+	// Increment the number of flushes. The background syncing uses this.
+	db.flushes++
+	return err
+}
+
+// committed records a commit that changed data, and publishes its changes to
+// the subscribers and notifiers. The changes func is only called when the
+// changes are needed, and are returned for the OnCommit function.
+// This must be called while holding the database lock.
+func (db *DB) committed(changes func() []Change) []Change {
+	db.commits++
+	cdc := db.config.ChangeRetention > 0
+	notify := db.notifiers.active()
+	if db.config.OnCommit == nil && !cdc && !notify {
+		return nil
+	}
+	list := changes()
+	if cdc {
+		db.seq++
+		db.changelog.append(ChangeBatch{
+			Seq:     db.seq,
+			Changes: list,
+		}, db.config.ChangeRetention)
+	}
+	if notify {
+		db.notifiers.publish(list)
+	}
+	return list
+}
+
+// changes returns the changes made by the transaction, ordered by key.
+// This must be called prior to unlocking the database.
+func (tx *Tx) changes() []Change {
+	now := tx.db.now()
+	var changes []Change
+	for key, item := range tx.wc.commitItems {
+		old := tx.original(key)
+		if old == nil && item == nil {
+			// deleting a key that never existed is not a change.
+			continue
+		}
+		change := Change{Key: key, Deleted: item == nil}
+		change.Expired = change.Deleted && tx.wc.expired[key]
+		if old != nil {
+			change.OldValue, change.Existed = old.val, true
+		}
+		if item != nil {
+			change.NewValue, change.TTL = item.val, item.changeTTL(now)
+		}
+		changes = append(changes, change)
+	}
+	if tx.wc.rbkeys != nil {
+		// A deleteAll removed every key that is not in the commit items.
+		deleted := func(key string, old *dbItem) {
+			if old == nil {
+				return
+			}
+			if _, ok := tx.wc.commitItems[key]; ok {
+				return
+			}
+			changes = append(changes, Change{
+				Key: key, OldValue: old.val, Existed: true, Deleted: true,
+			})
+		}
+		tx.wc.rbkeys.Ascend(nil, func(item interface{}) bool {
+			dbi := item.(*dbItem)
+			deleted(dbi.key, tx.original(dbi.key))
+			return true
+		})
+		// Keys that were removed before the deleteAll are not in its tree.
+		for key, old := range tx.wc.rollbackItems {
+			if tx.wc.rbkeys.Get(&dbItem{key: key}) == nil {
+				deleted(key, old)
+			}
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Key < changes[j].Key
+	})
+	return changes
+}
+
+// ChangeBatch is the list of changes of a single committed transaction, as
+// delivered to a Subscription.
+type ChangeBatch struct {
+	// Seq is the sequence number of the transaction. Passing this number to
+	// DB.Subscribe resumes the stream after this batch.
+	Seq uint64
+	// Changes are the changes of the transaction that match the pattern of
+	// the subscription, ordered by key. The slice must not be modified.
+	Changes []Change
+	// Snapshot is true when the batch is a full copy of the matching keys
+	// at Seq, rather than the changes of a transaction. A subscriber
+	// receives a snapshot when it falls too far behind the retained
+	// batches, and should replace its state with the snapshot.
+	Snapshot bool
+}
+
+// changeLog retains the most recent change batches for subscribers.
+type changeLog struct {
+	mu      sync.Mutex
+	batches []ChangeBatch // ordered by seq
+	subs    map[*Subscription]struct{}
+	closed  bool
+}
+
+// append adds a batch to the log and wakes the subscribers.
+// This must be called while holding the database lock.
+func (cl *changeLog) append(batch ChangeBatch, retention int) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.batches = append(cl.batches, batch)
+	if n := len(cl.batches) - retention; n > 0 {
+		copy(cl.batches, cl.batches[n:])
+		for i := retention; i < len(cl.batches); i++ {
+			cl.batches[i] = ChangeBatch{}
+		}
+		cl.batches = cl.batches[:retention]
+	}
+	for sub := range cl.subs {
+		select {
+		case sub.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// since returns the retained batches that follow seq. Returns false when the
+// batches directly following seq are no longer retained.
+func (cl *changeLog) since(seq, last uint64) ([]ChangeBatch, bool) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if seq >= last {
+		return nil, seq == last
+	}
+	if len(cl.batches) == 0 || cl.batches[0].Seq > seq+1 {
+		return nil, false
+	}
+	i := sort.Search(len(cl.batches), func(i int) bool {
+		return cl.batches[i].Seq > seq
+	})
+	return append([]ChangeBatch(nil), cl.batches[i:]...), true
+}
+
+// close closes all subscriptions.
+func (cl *changeLog) close() {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	cl.closed = true
+	for sub := range cl.subs {
+		sub.close()
+	}
+	cl.subs = nil
+}
+
+// Subscription is a stream of change batches. See DB.Subscribe.
+type Subscription struct {
+	// C delivers the change batches in order of their sequence numbers.
+	// It is closed when the subscription or the database is closed.
+	C <-chan ChangeBatch
+
+	db      *DB
+	pattern string
+	wake    chan struct{}
+	quit    chan struct{}
+	once    sync.Once
+}
+
+// Subscribe returns a stream of the changes committed after the sequence
+// number fromSeq, for the keys that match the pattern. Use zero to receive
+// all of the retained changes, or the Seq of the last batch that was
+// processed to resume a previous stream.
+//
+// When the changes following fromSeq are no longer retained, the stream
+// starts with a Snapshot batch containing the matching keys, followed by
+// the changes after it. A subscriber that does not keep up with the
+// database is handled in the same way.
+//
+// Returns ErrInvalidOperation when Config.ChangeRetention is zero.
+func (db *DB) Subscribe(fromSeq uint64, pattern string) (*Subscription, error) {
+	if db.isClosing() {
+		return nil, ErrDatabaseClosed
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return nil, ErrDatabaseClosed
+	}
+	if db.config.ChangeRetention <= 0 {
+		return nil, ErrInvalidOperation
+	}
+	c := make(chan ChangeBatch)
+	sub := &Subscription{
+		C:       c,
+		db:      db,
+		pattern: pattern,
+		wake:    make(chan struct{}, 1),
+		quit:    make(chan struct{}),
+	}
+	db.changelog.mu.Lock()
+	if db.changelog.subs == nil {
+		db.changelog.subs = make(map[*Subscription]struct{})
+	}
+	db.changelog.subs[sub] = struct{}{}
+	db.changelog.mu.Unlock()
+	go sub.run(c, fromSeq)
+	return sub, nil
+}
+
+// Close closes the subscription.
+func (sub *Subscription) Close() {
+	sub.db.changelog.mu.Lock()
+	delete(sub.db.changelog.subs, sub)
+	sub.db.changelog.mu.Unlock()
+	sub.close()
+}
+
+func (sub *Subscription) close() {
+	sub.once.Do(func() { close(sub.quit) })
+}
+
+// run delivers the batches to the subscriber until the subscription is
+// closed.
+func (sub *Subscription) run(c chan<- ChangeBatch, seq uint64) {
+	defer close(c)
+	for {
+		sub.db.mu.RLock()
+		last, closed := sub.db.seq, sub.db.closed
+		batches, ok := sub.db.changelog.since(seq, last)
+		var snap *DB
+		if !ok && !closed {
+			snap = sub.db.snapshot()
+		}
+		sub.db.mu.RUnlock()
+		if closed {
+			return
+		}
+		if snap != nil {
+			batches = []ChangeBatch{snap.snapshotBatch(sub.pattern)}
+		}
+		for _, batch := range batches {
+			if !batch.Snapshot && sub.pattern != "*" {
+				batch.Changes = filterChanges(batch.Changes, sub.pattern)
+			}
+			if len(batch.Changes) > 0 || batch.Snapshot {
+				select {
+				case c <- batch:
+				case <-sub.quit:
+					return
+				}
+			}
+			seq = batch.Seq
+		}
+		if len(batches) == 0 {
+			select {
+			case <-sub.wake:
+			case <-sub.quit:
+				return
+			}
+		}
+	}
+}
+
+// snapshotBatch returns the keys matching the pattern as a single batch.
+func (db *DB) snapshotBatch(pattern string) ChangeBatch {
+	batch := ChangeBatch{Seq: db.seq, Snapshot: true}
+	now := db.now()
+	btreeAscend(db.keys, func(item interface{}) bool {
+		dbi := item.(*dbItem)
+		if dbi.expired(now) || (pattern != "*" && !match.Match(dbi.key, pattern)) {
+			return true
+		}
+		change := Change{Key: dbi.key, NewValue: dbi.val,
+			TTL: dbi.changeTTL(now)}
+		batch.Changes = append(batch.Changes, change)
+		return true
+	})
+	return batch
+}
+
+// filterChanges returns the changes with keys matching the pattern.
+func filterChanges(changes []Change, pattern string) []Change {
+	var filtered []Change
+	for _, change := range changes {
+		if match.Match(change.Key, pattern) {
+			filtered = append(filtered, change)
+		}
+	}
+	return filtered
+}
+
+// EventType is the type of a keyspace event. The types are bit flags that
+// can be combined to select the events of a Notifier. The names follow the
+// keyspace notifications of Redis.
+type EventType int
+
+const (
+	// EventSet is raised when a key is set.
+	EventSet EventType = 1 << iota
+	// EventDel is raised when a key is deleted, including by DeleteAll.
+	EventDel
+	// EventExpire is raised when a key is given a time-to-live. It follows
+	// the EventSet of the key.
+	EventExpire
+	// EventExpired is raised when a key is removed by the background process
+	// because its time-to-live has passed.
+	EventExpired
+
+	// EventAll selects every type of event.
+	EventAll = EventSet | EventDel | EventExpire | EventExpired
+)
+
+// String returns the name of the event type.
+func (t EventType) String() string {
+	switch t {
+	case EventSet:
+		return "set"
+	case EventDel:
+		return "del"
+	case EventExpire:
+		return "expire"
+	case EventExpired:
+		return "expired"
+	}
+	return "unknown"
+}
+
+// KeyEvent is a keyspace event delivered by a Notifier.
+type KeyEvent struct {
+	Type EventType
+	Key  string
+}
+
+// OverflowPolicy determines what happens to the events of a Notifier when
+// its channel buffer is full.
+type OverflowPolicy int
+
+const (
+	// DropNewest discards the event that does not fit in the buffer.
+	DropNewest OverflowPolicy = 0
+	// DropOldest discards the oldest buffered event to make room for the
+	// new event.
+	DropOldest OverflowPolicy = 1
+	// CloseOnOverflow closes the channel of the notifier.
+	CloseOnOverflow OverflowPolicy = 2
+)
+
+// NotifyOptions represents options for a Notifier.
+type NotifyOptions struct {
+	// Events selects the types of events. Zero selects all events.
+	Events EventType
+	// Buffer is the size of the channel buffer. The default is 1024.
+	Buffer int
+	// Overflow is the policy used when the buffer is full.
+	// The default is DropNewest.
+	Overflow OverflowPolicy
+}
+
+// Notifier delivers the keyspace events for keys matching a pattern.
+// See DB.Notify.
+type Notifier struct {
+	// C delivers the events in the order that they were committed. It is
+	// closed when the notifier or the database is closed, or when the
+	// buffer overflows and the policy is CloseOnOverflow.
+	C <-chan KeyEvent
+
+	c       chan KeyEvent
+	db      *DB
+	pattern string
+	events  EventType
+	policy  OverflowPolicy
+	dropped uint64
+}
+
+// notifiers is the set of notifiers of a database.
+type notifiers struct {
+	mu   sync.Mutex
+	list map[*Notifier]struct{}
+}
+
+// Notify returns a Notifier that receives the keyspace events for the keys
+// matching the pattern. The events are sent without blocking the commit of
+// a transaction, and the overflow policy of the options decides what
+// happens when the receiver does not keep up. Passing nil for opts uses the
+// defaults.
+func (db *DB) Notify(pattern string, opts *NotifyOptions) (*Notifier, error) {
+	if db.isClosing() {
+		return nil, ErrDatabaseClosed
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.closed {
+		return nil, ErrDatabaseClosed
+	}
+	var nopts NotifyOptions
+	if opts != nil {
+		nopts = *opts
+	}
+	if nopts.Events == 0 {
+		nopts.Events = EventAll
+	}
+	if nopts.Buffer <= 0 {
+		nopts.Buffer = 1024
+	}
+	c := make(chan KeyEvent, nopts.Buffer)
+	n := &Notifier{
+		C:       c,
+		c:       c,
+		db:      db,
+		pattern: pattern,
+		events:  nopts.Events,
+		policy:  nopts.Overflow,
+	}
+	db.notifiers.mu.Lock()
+	if db.notifiers.list == nil {
+		db.notifiers.list = make(map[*Notifier]struct{})
+	}
+	db.notifiers.list[n] = struct{}{}
+	db.notifiers.mu.Unlock()
+	return n, nil
+}
+
+// Close closes the notifier.
+func (n *Notifier) Close() {
+	n.db.notifiers.mu.Lock()
+	defer n.db.notifiers.mu.Unlock()
+	if _, ok := n.db.notifiers.list[n]; ok {
+		delete(n.db.notifiers.list, n)
+		close(n.c)
+	}
+}
+
+// Dropped returns the number of events that were discarded because the
+// buffer was full.
+func (n *Notifier) Dropped() uint64 {
+	n.db.notifiers.mu.Lock()
+	defer n.db.notifiers.mu.Unlock()
+	return n.dropped
+}
+
+// send delivers an event without blocking.
+// This must be called while holding the notifiers lock.
+func (n *Notifier) send(ev KeyEvent) (ok bool) {
+	if n.events&ev.Type == 0 {
+		return true
+	}
+	select {
+	case n.c <- ev:
+		return true
+	default:
+	}
+	switch n.policy {
+	case DropOldest:
+		select {
+		case <-n.c:
+			n.dropped++
+		default:
+		}
+		select {
+		case n.c <- ev:
+		default:
+			n.dropped++
+		}
+	case CloseOnOverflow:
+		return false
+	default:
+		n.dropped++
+	}
+	return true
+}
+
+// active returns true when there are notifiers.
+func (ns *notifiers) active() bool {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	return len(ns.list) > 0
+}
+
+// publish sends the events for the changes to the notifiers.
+// This must be called while holding the database lock, which keeps the
+// events in the order of the commits.
+func (ns *notifiers) publish(changes []Change) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	for n := range ns.list {
+		for _, change := range changes {
+			if n.pattern != "*" && !match.Match(change.Key, n.pattern) {
+				continue
+			}
+			ok := true
+			switch {
+			case change.Expired:
+				ok = n.send(KeyEvent{EventExpired, change.Key})
+			case change.Deleted:
+				ok = n.send(KeyEvent{EventDel, change.Key})
+			default:
+				ok = n.send(KeyEvent{EventSet, change.Key})
+				if ok && change.TTL > 0 {
+					ok = n.send(KeyEvent{EventExpire, change.Key})
+				}
+			}
+			if !ok {
+				delete(ns.list, n)
+				close(n.c)
+				break
+			}
+		}
+	}
+}
+
+// close closes all notifiers.
+func (ns *notifiers) close() {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	for n := range ns.list {
+		close(n.c)
+	}
+	ns.list = nil
+}
+
 // Rollback closes the transaction and reverts all mutable operations that
 // were performed on the transaction such as Set() and Delete().
 //
@@ -1272,26 +3223,255 @@ func (tx *Tx) Rollback() error {
 	if tx.db == nil {
 		return ErrTxClosed
 	}
-	// The rollback func does the heavy lifting.
-	if tx.writable {
-		tx.rollbackInner()
+	// The rollback func does the heavy lifting. The changes of an optimistic
+	// transaction only exist in its snapshot, which is simply discarded.
+	if tx.writable && tx.occ == nil {
+		tx.rollbackInner()
+	}
+	// unlock the database for more transactions.
+	tx.unlock()
+	tx.untrack()
+	// Clear the db field to disable this transaction from future use.
+	tx.db = nil
+	return nil
+}
+
+// untrack stops counting the transaction as open, once it has finished.
+func (tx *Tx) untrack() {
+	if !tx.snapshot {
+		tx.db.untrackTx()
+	}
+}
+
+// Batch is a writer for loading many keys into the database at once. The
+// operations are applied in bulk when the batch is committed, which is about
+// twice as fast as performing them in a transaction, but the operations
+// cannot read from the database, and a batch cannot be rolled back.
+//
+// A batch is all-or-nothing. When writing the batch to disk fails, none of
+// the operations are applied.
+//
+// A batch is not safe for concurrent use.
+type Batch struct {
+	db  *DB
+	ops []batchOp
+}
+
+// batchOp is a single operation of a batch. A nil item is a delete.
+type batchOp struct {
+	key      string
+	item     *dbItem
+	pos      int  // the position of the operation in the batch
+	defaults bool // apply the TTL policies of the database
+}
+
+// Batch returns a new batch writer for the database.
+func (db *DB) Batch() *Batch {
+	return &Batch{db: db}
+}
+
+// Set adds a set operation to the batch. The NX, XX, and KeepTTL options
+// depend on the existing value and are not allowed in a batch, returning
+// ErrInvalidOperation. The TTL of an expiring key is counted from the call
+// to Set, except for the default TTL of the TTLPolicies, which is counted
+// from the call to Commit.
+func (b *Batch) Set(key, value string, opts *SetOptions) error {
+	item := &dbItem{key: key, val: value}
+	if opts != nil {
+		if opts.NX || opts.XX || opts.KeepTTL || opts.conflicting() {
+			return ErrInvalidOperation
+		}
+		var now time.Time
+		if opts.Expires {
+			// the clock is part of the config, which is guarded by the lock.
+			b.db.mu.RLock()
+			now = b.db.now()
+			b.db.mu.RUnlock()
+		}
+		item.opts = opts.itemOpts(now)
+	}
+	b.ops = append(b.ops, batchOp{key: key, item: item, pos: len(b.ops),
+		defaults: item.opts == nil && (opts == nil || !opts.Persist)})
+	return nil
+}
+
+// Delete adds a delete operation to the batch. Deleting a key that does not
+// exist is not an error.
+func (b *Batch) Delete(key string) {
+	b.ops = append(b.ops, batchOp{key: key, pos: len(b.ops)})
+}
+
+// Len returns the number of operations in the batch.
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// Reset discards the operations of the batch.
+func (b *Batch) Reset() {
+	b.ops = b.ops[:0]
+}
+
+// Commit applies the operations to the database. When the same key has more
+// than one operation, the last one wins. The batch is empty afterwards and
+// may be reused.
+func (b *Batch) Commit() error {
+	// sort and keep the last operation of each key.
+	sort.Slice(b.ops, func(i, j int) bool {
+		if b.ops[i].key != b.ops[j].key {
+			return b.ops[i].key < b.ops[j].key
+		}
+		return b.ops[i].pos < b.ops[j].pos
+	})
+	ops := b.ops[:0]
+	for i := range b.ops {
+		if i+1 < len(b.ops) && b.ops[i+1].key == b.ops[i].key {
+			continue
+		}
+		ops = append(ops, b.ops[i])
+	}
+	defer b.Reset()
+	if len(ops) == 0 {
+		return nil
+	}
+	db := b.db
+	if db.isClosing() {
+		return ErrDatabaseClosed
+	}
+	db.mu.Lock()
+	if db.closed {
+		db.mu.Unlock()
+		return ErrDatabaseClosed
+	}
+	if len(db.config.TTLPolicies) > 0 {
+		now := db.now()
+		for _, op := range ops {
+			if op.defaults {
+				// the item is not shared until it's applied.
+				op.item.opts = db.defaultOpts(op.key, now)
+			}
+		}
+	}
+	if db.persist {
+		db.buf = db.buf[:0]
+		now := db.now()
+		for _, op := range ops {
+			if op.item == nil {
+				db.buf = (&dbItem{key: op.key}).writeDeleteTo(db.buf)
+			} else {
+				db.buf = op.item.writeSetTo(db.buf, now)
+			}
+		}
+		if db.config.ChangeRetention > 0 {
+			db.buf = appendSeq(db.buf, db.seq+1)
+		}
+		if err := db.flush(); err != nil {
+			db.mu.Unlock()
+			return err
+		}
+	}
+	prevs := db.apply(ops)
+	changes := db.committed(func() []Change {
+		now := db.now()
+		var changes []Change
+		for i, op := range ops {
+			if prevs[i] == nil && op.item == nil {
+				continue
+			}
+			change := Change{Key: op.key, Deleted: op.item == nil}
+			if prevs[i] != nil {
+				change.OldValue, change.Existed = prevs[i].val, true
+			}
+			if op.item != nil {
+				change.NewValue = op.item.val
+				change.TTL = op.item.changeTTL(now)
+			}
+			changes = append(changes, change)
+		}
+		return changes
+	})
+	onCommit := db.config.OnCommit
+	db.mu.Unlock()
+	if onCommit != nil && len(changes) > 0 {
+		onCommit(changes)
+	}
+	return nil
+}
+
+// apply applies the sorted operations of a batch to the keys, expires, and
+// index trees. The trees are loaded in the order of their items, which is
+// faster than inserting the items one by one. Returns the previous items.
+func (db *DB) apply(ops []batchOp) []*dbItem {
+	prevs := make([]*dbItem, len(ops))
+	var loads map[*index][]*dbItem
+	for i, op := range ops {
+		if op.item == nil {
+			prevs[i] = db.deleteFromDatabase(&dbItem{key: op.key})
+			if prevs[i] != nil {
+				db.tombstone(op.key, prevs[i].ver)
+			}
+			continue
+		}
+		item := op.item
+		db.vers++
+		item.ver = db.vers
+		if prev := db.keys.Load(item); prev != nil {
+			pdbi := prev.(*dbItem)
+			prevs[i] = pdbi
+			if pdbi.opts != nil && pdbi.opts.ex {
+				db.exps.Delete(pdbi)
+			}
+			for _, idx := range db.idxs {
+				if !idx.match(pdbi.key) {
+					continue
+				}
+				if idx.btr != nil {
+					idx.btr.Delete(pdbi)
+				}
+				if idx.rtr != nil {
+					idx.rtr.Remove(pdbi)
+				}
+			}
+		}
+		if item.opts != nil && item.opts.ex {
+			db.exps.Set(item)
+		}
+		for _, idx := range db.idxs {
+			if !idx.match(item.key) {
+				continue
+			}
+			if idx.btr != nil {
+				if loads == nil {
+					loads = make(map[*index][]*dbItem)
+				}
+				loads[idx] = append(loads[idx], item)
+			}
+			if idx.rtr != nil {
+				idx.rtr.Insert(item)
+			}
+		}
+	}
+	for idx, items := range loads {
+		sort.Slice(items, func(i, j int) bool {
+			return idx.btr.Less(items[i], items[j])
+		})
+		for _, item := range items {
+			idx.btr.Load(item)
+		}
 	}
-	// unlock the database for more transactions.
-	tx.unlock()
-	// Clear the db field to disable this transaction from future use.
-	tx.db = nil
-	return nil
+	return prevs
 }
 
 // dbItemOpts holds various meta information about an item.
 type dbItemOpts struct {
-	ex   bool      // does this item expire?
-	exat time.Time // when does this item expire?
+	ex    bool          // does this item expire?
+	exat  time.Time     // when does this item expire?
+	slide time.Duration // the ttl that restarts when the item is read.
 }
 type dbItem struct {
 	key, val string      // the binary key and value
 	opts     *dbItemOpts // optional meta information
 	keyless  bool        // keyless item for scanning
+	ver      uint64      // the version, assigned when stored
 }
 
 // estIntSize returns the string representions size.
@@ -1326,8 +3506,12 @@ func (dbi *dbItem) estAOFSetSize() int {
 		n += estBulkStringSize("set")
 		n += estBulkStringSize(dbi.key)
 		n += estBulkStringSize(dbi.val)
-		n += estBulkStringSize("ex")
-		n += estBulkStringSize("99") // estimate two byte bulk string
+		n += estBulkStringSize("pxat")
+		n += estBulkStringSize("9999999999999") // estimate unix milliseconds
+		if dbi.opts.slide > 0 {
+			n += estBulkStringSize("sliding")
+			n += estBulkStringSize("99999") // estimate five byte bulk string
+		}
 	} else {
 		n += estArraySize(3)
 		n += estBulkStringSize("set")
@@ -1356,19 +3540,28 @@ func appendBulkString(buf []byte, s string) []byte {
 // writeSetTo writes an item as a single SET record to the a bufio Writer.
 func (dbi *dbItem) writeSetTo(buf []byte, now time.Time) []byte {
 	if dbi.opts != nil && dbi.opts.ex {
-		buf = appendArray(buf, 5)
+		if dbi.opts.slide > 0 {
+			buf = appendArray(buf, 7)
+		} else {
+			buf = appendArray(buf, 5)
+		}
 		buf = appendBulkString(buf, "set")
 		buf = appendBulkString(buf, dbi.key)
 		buf = appendBulkString(buf, dbi.val)
 		if useAbsEx {
-			ex := dbi.opts.exat.Unix()
-			buf = appendBulkString(buf, "ae")
+			ex := dbi.opts.exat.UnixMilli()
+			buf = appendBulkString(buf, "pxat")
 			buf = appendBulkString(buf, strconv.FormatUint(uint64(ex), 10))
 		} else {
-			ex := dbi.opts.exat.Sub(now) / time.Second
-			buf = appendBulkString(buf, "ex")
+			ex := dbi.opts.exat.Sub(now) / time.Millisecond
+			buf = appendBulkString(buf, "px")
 			buf = appendBulkString(buf, strconv.FormatUint(uint64(ex), 10))
 		}
+		if dbi.opts.slide > 0 {
+			slide := dbi.opts.slide / time.Millisecond
+			buf = appendBulkString(buf, "sliding")
+			buf = appendBulkString(buf, strconv.FormatUint(uint64(slide), 10))
+		}
 	} else {
 		buf = appendArray(buf, 3)
 		buf = appendBulkString(buf, "set")
@@ -1386,10 +3579,48 @@ func (dbi *dbItem) writeDeleteTo(buf []byte) []byte {
 	return buf
 }
 
-// expired evaluates id the item has expired. This will always return false when
-// the item does not have `opts.ex` set to true.
-func (dbi *dbItem) expired() bool {
-	return dbi.opts != nil && dbi.opts.ex && time.Now().After(dbi.opts.exat)
+// writeExpireTo writes the expiration of an item as a single PEXPIREAT or
+// PERSIST record, without the value.
+func (dbi *dbItem) writeExpireTo(buf []byte) []byte {
+	if dbi.opts != nil && dbi.opts.ex {
+		buf = appendArray(buf, 3)
+		buf = appendBulkString(buf, "pexpireat")
+		buf = appendBulkString(buf, dbi.key)
+		ex := dbi.opts.exat.UnixMilli()
+		buf = appendBulkString(buf, strconv.FormatUint(uint64(ex), 10))
+	} else {
+		buf = appendArray(buf, 2)
+		buf = appendBulkString(buf, "persist")
+		buf = appendBulkString(buf, dbi.key)
+	}
+	return buf
+}
+
+// appendSeq appends a SEQ record, which holds the sequence number of the
+// last change batch, for change data capture.
+func appendSeq(buf []byte, seq uint64) []byte {
+	buf = appendArray(buf, 2)
+	buf = appendBulkString(buf, "seq")
+	buf = appendBulkString(buf, strconv.FormatUint(seq, 10))
+	return buf
+}
+
+// expired evaluates id the item has expired at the provided time. This will
+// always return false when the item does not have `opts.ex` set to true.
+func (dbi *dbItem) expired(now time.Time) bool {
+	return dbi.opts != nil && dbi.opts.ex && now.After(dbi.opts.exat)
+}
+
+// changeTTL returns the time-to-live of the item for a Change. This is zero
+// when the item does not expire, and never less than a nanosecond otherwise.
+func (dbi *dbItem) changeTTL(now time.Time) time.Duration {
+	if dbi.opts == nil || !dbi.opts.ex {
+		return 0
+	}
+	if ttl := dbi.opts.exat.Sub(now); ttl > 0 {
+		return ttl
+	}
+	return time.Nanosecond
 }
 
 // MaxTime from http://stackoverflow.com/questions/25065055#32620397
@@ -1442,6 +3673,10 @@ func (dbi *dbItem) Less(dbi2 *dbItem, ctx interface{}) bool {
 }
 
 func lessCtx(ctx interface{}) func(a, b interface{}) bool {
+	if idx, ok := ctx.(*index); ok && idx.fields != nil {
+		// composite indexes are also compared with tuple pivots.
+		return idx.compositeLess
+	}
 	return func(a, b interface{}) bool {
 		return a.(*dbItem).Less(b.(*dbItem), ctx)
 	}
@@ -1465,6 +3700,62 @@ type SetOptions struct {
 	// before being evicted. The Expires field must also be set to true.
 	// TTL stands for Time-To-Live.
 	TTL time.Duration
+	// NX indicates that the Set() must only happen when the key does not
+	// already exist. Otherwise ErrConditionFailed is returned.
+	NX bool
+	// XX indicates that the Set() must only happen when the key already
+	// exists. Otherwise ErrConditionFailed is returned.
+	XX bool
+	// KeepTTL indicates that the Set() must retain the expiration of the
+	// existing item. The Expires and TTL fields are only used when the key
+	// does not already exist.
+	KeepTTL bool
+	// ExpiresAt is the time that the key-value will be evicted. When this
+	// is not zero it's used instead of the Expires and TTL fields. The time
+	// is stored with millisecond precision.
+	ExpiresAt time.Time
+	// Sliding indicates that the TTL restarts each time that the key is
+	// read with Get. This is only used along with the Expires and TTL
+	// fields.
+	Sliding bool
+	// Persist indicates that the key-value never expires, even when it
+	// matches one of the TTLPolicies of the database. It cannot be combined
+	// with the Expires, ExpiresAt, or KeepTTL fields, which returns
+	// ErrInvalidOperation.
+	Persist bool
+}
+
+// conflicting returns true when the options ask for the key-value to never
+// expire and to expire at the same time.
+func (opts *SetOptions) conflicting() bool {
+	return opts.Persist &&
+		(opts.Expires || !opts.ExpiresAt.IsZero() || opts.KeepTTL)
+}
+
+// itemOpts returns the item options for the set options, if any.
+func (opts *SetOptions) itemOpts(now time.Time) *dbItemOpts {
+	exat, ok := opts.expiration(now)
+	if !ok {
+		return nil
+	}
+	iopts := &dbItemOpts{ex: true, exat: exat}
+	if opts.Sliding && opts.ExpiresAt.IsZero() && opts.TTL > 0 {
+		iopts.slide = opts.TTL
+	}
+	return iopts
+}
+
+// expiration returns the expiration time of the options, if any. The TTL is
+// counted from now.
+func (opts *SetOptions) expiration(now time.Time) (exat time.Time, ok bool) {
+	if !opts.ExpiresAt.IsZero() {
+		return opts.ExpiresAt.Truncate(time.Millisecond), true
+	}
+	if opts.Expires {
+		// Convert the TTL to an absolute time.
+		return now.Add(opts.TTL), true
+	}
+	return time.Time{}, false
 }
 
 // GetLess returns the less function for an index. This is handy for
@@ -1508,107 +3799,704 @@ func (tx *Tx) GetRect(index string) (func(s string) (min, max []float64),
 // transactions until the current transaction has successfully committed.
 //
 // Only a writable transaction can be used with this operation.
-// This operation is not allowed during iterations such as Ascend* & Descend*.
+// This operation is not allowed during iterations such as Ascend* & Descend*,
+// unless the DeferIteratingMutations config option is set.
 func (tx *Tx) Set(key, value string, opts *SetOptions) (previousValue string,
 	replaced bool, err error) {
 	if tx.db == nil {
 		return "", false, ErrTxClosed
 	} else if !tx.writable {
 		return "", false, ErrTxNotWritable
-	} else if tx.wc.itercount > 0 {
+	} else if tx.wc.itercount > 0 && !tx.db.config.DeferIteratingMutations {
 		return "", false, ErrTxIterating
+	} else if opts != nil && opts.conflicting() {
+		return "", false, ErrInvalidOperation
 	}
 	item := &dbItem{key: key, val: value}
+	defaults := opts == nil || !opts.Persist
+	if opts != nil && (opts.NX || opts.XX || opts.KeepTTL) {
+		tx.observe(key)
+		prev := tx.get(key)
+		exists := prev != nil && !prev.expired(tx.db.now())
+		if (opts.NX && exists) || (opts.XX && !exists) {
+			return "", false, ErrConditionFailed
+		}
+		if opts.KeepTTL && exists {
+			if prev.opts != nil && prev.opts.ex {
+				item.opts = &dbItemOpts{ex: true, exat: prev.opts.exat,
+					slide: prev.opts.slide}
+			}
+			// do not apply the expiration options below
+			opts = nil
+			defaults = false
+		}
+	}
 	if opts != nil {
-		if opts.Expires {
-			// The caller is requesting that this item expires. Convert the
-			// TTL to an absolute time and bind it to the item.
-			item.opts = &dbItemOpts{ex: true, exat: time.Now().Add(opts.TTL)}
+		// The caller may be requesting that this item expires. Bind the
+		// absolute time to the item.
+		item.opts = opts.itemOpts(tx.db.now())
+	}
+	if item.opts == nil && defaults && len(tx.db.config.TTLPolicies) > 0 {
+		item.opts = tx.db.defaultOpts(key, tx.db.now())
+	}
+	var prev *dbItem
+	if tx.wc.itercount > 0 {
+		prev = tx.deferItem(key, item)
+	} else {
+		prev = tx.setItem(item)
+	}
+	if prev != nil && !prev.expired(tx.db.now()) {
+		previousValue, replaced = prev.val, true
+	}
+	return previousValue, replaced, nil
+}
+
+// CompareAndSwap sets the value for a key only when the key exists and its
+// current value equals oldValue. Otherwise ErrConditionFailed is returned.
+// The opts param is the same as for Set(), except that NX and XX are ignored.
+//
+// Only a writable transaction can be used with this operation.
+func (tx *Tx) CompareAndSwap(key, oldValue, newValue string,
+	opts *SetOptions) error {
+	if tx.db == nil {
+		return ErrTxClosed
+	} else if !tx.writable {
+		return ErrTxNotWritable
+	}
+	val, err := tx.Get(key)
+	if err == ErrNotFound || (err == nil && val != oldValue) {
+		return ErrConditionFailed
+	} else if err != nil {
+		return err
+	}
+	if opts != nil {
+		nopts := *opts
+		nopts.NX, nopts.XX = false, false
+		opts = &nopts
+	}
+	_, _, err = tx.Set(key, newValue, tx.updateOpts(key, true, opts))
+	return err
+}
+
+// updateOpts returns the set options for changing the value of a key. The
+// TTL policies only apply when a key is created, so a nil opts keeps the
+// expiration of an existing key that matches a policy, rather than applying
+// the policy again.
+func (tx *Tx) updateOpts(key string, exists bool,
+	opts *SetOptions) *SetOptions {
+	if opts == nil && exists {
+		if _, ok := tx.db.ttlPolicy(key); ok {
+			return &SetOptions{KeepTTL: true}
+		}
+	}
+	return opts
+}
+
+// CompareAndDelete deletes a key only when the key exists and its current
+// value equals oldValue. Otherwise ErrConditionFailed is returned.
+//
+// Only a writable transaction can be used with this operation.
+func (tx *Tx) CompareAndDelete(key, oldValue string) error {
+	if tx.db == nil {
+		return ErrTxClosed
+	} else if !tx.writable {
+		return ErrTxNotWritable
+	}
+	val, err := tx.Get(key)
+	if err == ErrNotFound || (err == nil && val != oldValue) {
+		return ErrConditionFailed
+	} else if err != nil {
+		return err
+	}
+	_, err = tx.Delete(key)
+	return err
+}
+
+// modify sets a new value for a key that is computed from the current value
+// of the key. The fn function is provided the current value and whether the
+// key exists, and returns the new value. Returns the new value.
+func (tx *Tx) modify(key string, opts *SetOptions,
+	fn func(val string, exists bool) (string, error)) (string, error) {
+	if tx.db == nil {
+		return "", ErrTxClosed
+	} else if !tx.writable {
+		return "", ErrTxNotWritable
+	}
+	val, err := tx.Get(key)
+	if err != nil && err != ErrNotFound {
+		return "", err
+	}
+	exists := err == nil
+	val, err = fn(val, exists)
+	if err != nil {
+		return "", err
+	}
+	opts = tx.updateOpts(key, exists, opts)
+	if _, _, err := tx.Set(key, val, opts); err != nil {
+		return "", err
+	}
+	return val, nil
+}
+
+// IncrBy increments the integer value of a key by delta, and returns the new
+// value. A key that does not exist is set to delta. ErrNotNumber is returned
+// when the current value is not an integer, and ErrInvalidOperation is
+// returned when the result overflows an int64.
+// The opts param is the same as for Set(). Use KeepTTL to retain the
+// expiration of the key.
+//
+// Only a writable transaction can be used with this operation.
+func (tx *Tx) IncrBy(key string, delta int64, opts *SetOptions) (int64,
+	error) {
+	var n int64
+	fn := func(val string, exists bool) (string, error) {
+		if exists {
+			var err error
+			n, err = strconv.ParseInt(val, 10, 64)
+			if err != nil {
+				return "", ErrNotNumber
+			}
+		}
+		if (delta > 0 && n > math.MaxInt64-delta) ||
+			(delta < 0 && n < math.MinInt64-delta) {
+			return "", ErrInvalidOperation
+		}
+		n += delta
+		return strconv.FormatInt(n, 10), nil
+	}
+	if _, err := tx.modify(key, opts, fn); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// IncrByFloat increments the floating point value of a key by delta, and
+// returns the new value. A key that does not exist is set to delta.
+// ErrNotNumber is returned when the current value is not a number, and
+// ErrInvalidOperation is returned when the result is not a finite number.
+// The opts param is the same as for Set(). Use KeepTTL to retain the
+// expiration of the key.
+//
+// Only a writable transaction can be used with this operation.
+func (tx *Tx) IncrByFloat(key string, delta float64, opts *SetOptions) (
+	float64, error) {
+	var f float64
+	fn := func(val string, exists bool) (string, error) {
+		if exists {
+			var err error
+			f, err = strconv.ParseFloat(val, 64)
+			if err != nil {
+				return "", ErrNotNumber
+			}
+		}
+		f += delta
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return "", ErrInvalidOperation
+		}
+		return strconv.FormatFloat(f, 'f', -1, 64), nil
+	}
+	if _, err := tx.modify(key, opts, fn); err != nil {
+		return 0, err
+	}
+	return f, nil
+}
+
+// Append appends a value to the end of the current value of a key, and
+// returns the length of the new value. A key that does not exist is set to
+// the value.
+// The opts param is the same as for Set(). Use KeepTTL to retain the
+// expiration of the key.
+//
+// Only a writable transaction can be used with this operation.
+func (tx *Tx) Append(key, value string, opts *SetOptions) (int, error) {
+	fn := func(val string, exists bool) (string, error) {
+		return val + value, nil
+	}
+	val, err := tx.modify(key, opts, fn)
+	return len(val), err
+}
+
+// GetSet sets the value for a key, and returns the previous value.
+// This is the same as Set(), and it's provided for code that reads better
+// when swapping values.
+//
+// Only a writable transaction can be used with this operation.
+func (tx *Tx) GetSet(key, value string, opts *SetOptions) (
+	previousValue string, replaced bool, err error) {
+	return tx.Set(key, value, opts)
+}
+
+// maxSetRangeSize is the largest value that SetRange can produce.
+const maxSetRangeSize = 512 * 1024 * 1024
+
+// SetRange overwrites part of the current value of a key, starting at the
+// specified byte offset, and returns the length of the new value. The value
+// is padded with zero bytes when the offset is beyond its end. A key that
+// does not exist is treated as an empty value, but an empty value neither
+// changes nor creates the key. A negative offset, or one that would make the
+// value larger than 512MB, returns ErrInvalidOperation.
+// The opts param is the same as for Set(). Use KeepTTL to retain the
+// expiration of the key.
+//
+// Only a writable transaction can be used with this operation.
+func (tx *Tx) SetRange(key string, offset int, value string,
+	opts *SetOptions) (int, error) {
+	if offset < 0 || offset > maxSetRangeSize-len(value) {
+		return 0, ErrInvalidOperation
+	}
+	if value == "" {
+		// Nothing to overwrite or pad, so nothing is written, and a key
+		// that does not exist is not created.
+		if tx.db == nil {
+			return 0, ErrTxClosed
+		} else if !tx.writable {
+			return 0, ErrTxNotWritable
+		}
+		val, err := tx.Get(key)
+		if err == ErrNotFound {
+			return 0, nil
+		}
+		return len(val), err
+	}
+	fn := func(val string, exists bool) (string, error) {
+		size := len(val)
+		if offset+len(value) > size {
+			size = offset + len(value)
+		}
+		buf := make([]byte, size)
+		copy(buf, val)
+		copy(buf[offset:], value)
+		return string(buf), nil
+	}
+	val, err := tx.modify(key, opts, fn)
+	return len(val), err
+}
+
+// deferItem defers setting an item, or deleting a key when the item is nil,
+// until the current iterations have completed. Returns the previous item with
+// the same key, if any.
+func (tx *Tx) deferItem(key string, item *dbItem) (prev *dbItem) {
+	prev = tx.get(key)
+	if tx.wc.pending == nil {
+		tx.wc.pending = make(map[string]*dbItem)
+	}
+	tx.wc.pending[key] = item
+	return prev
+}
+
+// beginIter marks the start of an iteration. While iterating, mutations are
+// deferred or not allowed.
+func (tx *Tx) beginIter() {
+	if tx.wc != nil {
+		tx.wc.itercount++
+	}
+}
+
+// endIter marks the end of an iteration. The deferred mutations are applied
+// once the outermost iteration has completed.
+func (tx *Tx) endIter() {
+	if tx.wc != nil {
+		tx.wc.itercount--
+		if tx.wc.itercount == 0 && tx.wc.pending != nil {
+			tx.applyPending()
+		}
+	}
+}
+
+// applyPending applies the mutations that were deferred by iterators.
+func (tx *Tx) applyPending() {
+	for key, item := range tx.wc.pending {
+		if item == nil {
+			tx.deleteItem(key)
+		} else {
+			tx.setItem(item)
+		}
+	}
+	tx.wc.pending = nil
+}
+
+// get returns the item for a key, taking into account the mutations that are
+// deferred by iterators.
+func (tx *Tx) get(key string) *dbItem {
+	if tx.wc != nil && tx.wc.pending != nil {
+		if item, ok := tx.wc.pending[key]; ok {
+			return item
+		}
+	}
+	return tx.db.get(key)
+}
+
+// original returns the item for the key as it was at the start of the
+// transaction.
+func (tx *Tx) original(key string) *dbItem {
+	if tx.wc != nil {
+		if item, ok := tx.wc.rollbackItems[key]; ok {
+			return item
+		}
+		if tx.wc.rbkeys != nil {
+			if item := tx.wc.rbkeys.Get(&dbItem{key: key}); item != nil {
+				return item.(*dbItem)
+			}
+			return nil
+		}
+	}
+	return tx.db.get(key)
+}
+
+// WatchToken holds the state of watched keys. See Tx.Watch.
+type WatchToken struct {
+	vers  uint64            // the database version when watched
+	items map[string]uint64 // the item versions, zero when missing
+}
+
+// Watch returns a token that records the current state of the keys. The
+// token can be passed to Assert in a later transaction, which fails when
+// any of the keys has been modified in between. Expired keys are
+// considered to be missing. Each stored item has a version, so setting a key
+// to the same value is a change, and so is a missing key that was set and
+// then deleted again. The deletions of missing keys are tracked in a fixed
+// number of slots, which can rarely fail an assertion that should succeed.
+func (tx *Tx) Watch(keys ...string) (*WatchToken, error) {
+	if tx.db == nil {
+		return nil, ErrTxClosed
+	}
+	now := tx.db.now()
+	token := &WatchToken{vers: tx.db.vers,
+		items: make(map[string]uint64, len(keys))}
+	for _, key := range keys {
+		tx.observe(key)
+		item := tx.get(key)
+		if item != nil && item.expired(now) {
+			item = nil
+		}
+		token.items[key] = item.version()
+	}
+	return token, nil
+}
+
+// Assert returns ErrWatchedKeyChanged when any key of the token has been
+// modified since it was watched. The keys are compared to their state at the
+// start of this transaction, so the changes of the transaction itself are not
+// taken into account. For an optimistic transaction the keys are also checked
+// again at commit.
+func (tx *Tx) Assert(token *WatchToken) error {
+	if tx.db == nil {
+		return ErrTxClosed
+	}
+	if token == nil {
+		return ErrInvalidOperation
+	}
+	now := tx.db.now()
+	for key, watched := range token.items {
+		// Every change to the key stores an item with a new version. A key
+		// that is still missing may have been set and deleted in between,
+		// which the deleted versions tell.
+		tx.observe(key)
+		item := tx.original(key)
+		if item != nil && item.expired(now) {
+			item = nil
+		}
+		if item.version() != watched ||
+			(item == nil && tx.db.deletedSince(key, token.vers)) {
+			return ErrWatchedKeyChanged
+		}
+	}
+	if tx.occ != nil && token.vers < tx.occ.vers {
+		// the snapshot does not know the deletions, which are checked at
+		// commit from the time of the token.
+		tx.occ.vers = token.vers
+	}
+	return nil
+}
+
+// setItem inserts or replaces an item in the database and records the change
+// for rolling back and committing the transaction. Returns the previous item
+// with the same key, if any.
+func (tx *Tx) setItem(item *dbItem) (prev *dbItem) {
+	tx.observe(item.key)
+	tx.saveItem(item.key)
+	delete(tx.wc.ttlonly, item.key)
+	// Every change gets a new version, including the items of an optimistic
+	// transaction that are replayed from its snapshot.
+	item.ver = 0
+	// Insert the item into the keys tree.
+	prev = tx.db.insertIntoDatabase(item)
+
+	// insert into the rollback map if there has not been a deleteAll.
+	if tx.wc.rbkeys == nil {
+		// An item that did not previously exist gets a rollback entry with
+		// a nil value. A nil value indicates that the entry should be deleted
+		// on rollback. When the value is *not* nil, that means the entry
+		// should be reverted. We need to check the map to see if there isn't
+		// already an item that matches the same key.
+		if _, ok := tx.wc.rollbackItems[item.key]; !ok {
+			tx.wc.rollbackItems[item.key] = prev
 		}
 	}
-	// Insert the item into the keys tree.
-	prev := tx.db.insertIntoDatabase(item)
+	// For commits we simply assign the item to the map. We use this map to
+	// write the entry to disk.
+	tx.wc.recordCommit(item.key, item)
+	tx.wc.changed = true
+	return prev
+}
+
+// SetBytes is the same as Set except that the value is a byte slice.
+// The value is copied into the database, so the caller is free to reuse or
+// modify the slice after the call returns.
+//
+// The previousValue is not a copy. It references the memory of the replaced
+// item and must not be modified. See GetBytes for more information.
+func (tx *Tx) SetBytes(key string, value []byte, opts *SetOptions) (
+	previousValue []byte, replaced bool, err error) {
+	prev, replaced, err := tx.Set(key, string(value), opts)
+	if err != nil || !replaced {
+		return nil, replaced, err
+	}
+	return stringBytes(prev), true, nil
+}
+
+// Get returns a value for a key. If the item does not exist or if the item
+// has expired then ErrNotFound is returned. If ignoreExpired is true, then
+// the found value will be returned even if it is expired.
+//
+// Reading a key that was set with the Sliding option restarts its TTL, even
+// in a read-only transaction. The new expiration is not a change made by the
+// transaction, so it's not reported to OnCommit, change data capture, or
+// notifications, and it does not cause optimistic transactions to conflict.
+// It's applied, and written to disk, when the next transaction begins, or by
+// the background process within a second, unless the key is changed by then.
+func (tx *Tx) Get(key string, ignoreExpired ...bool) (val string, err error) {
+	if tx.db == nil {
+		return "", ErrTxClosed
+	}
+	var ignore bool
+	if len(ignoreExpired) != 0 {
+		ignore = ignoreExpired[0]
+	}
+	tx.observe(key)
+	item := tx.get(key)
+	now := tx.db.now()
+	if item == nil || (item.expired(now) && !ignore) {
+		// The item does not exists or has expired. Let's assume that
+		// the caller is only interested in items that have not expired.
+		return "", ErrNotFound
+	}
+	if item.opts != nil && item.opts.slide > 0 && !item.expired(now) {
+		tx.touch(item, now.Add(item.opts.slide))
+	}
+	return item.val, nil
+}
+
+// GetAndTouch returns a value for a key and sets the key to expire after
+// the ttl, restarting any previous expiration. Like the sliding expiration of
+// Get, the new expiration is not part of the transaction. It's applied when
+// the next transaction begins, or by the background process within a second,
+// unless the key is changed by then.
+// Use Expire to change the expiration as part of a writable transaction.
+func (tx *Tx) GetAndTouch(key string, ttl time.Duration) (val string,
+	err error) {
+	if tx.db == nil {
+		return "", ErrTxClosed
+	}
+	tx.observe(key)
+	item := tx.get(key)
+	now := tx.db.now()
+	if item == nil || item.expired(now) {
+		return "", ErrNotFound
+	}
+	tx.touch(item, now.Add(ttl))
+	return item.val, nil
+}
+
+// touch changes the expiration of an item that was read. The change is not
+// part of the transaction, and it's applied when the next transaction begins,
+// or by the background process within a second, unless the item has been
+// replaced by then. Snapshot transactions do not touch items, but optimistic
+// transactions do.
+func (tx *Tx) touch(item *dbItem, exat time.Time) {
+	db := tx.db
+	if tx.occ != nil {
+		// the snapshot shares its items with the database.
+		db = tx.occ.db
+	} else if tx.snapshot {
+		return
+	}
+	db.touchmu.Lock()
+	defer db.touchmu.Unlock()
+	if db.touches == nil {
+		db.touches = make(map[string]touch)
+	}
+	if t, ok := db.touches[item.key]; ok && t.item == item &&
+		t.exat.After(exat) {
+		return
+	}
+	db.touches[item.key] = touch{item: item, exat: exat}
+}
+
+// touch is an expiration change that is queued by reading an item.
+type touch struct {
+	item *dbItem   // the item that was read
+	exat time.Time // the new expiration
+}
+
+// version returns the version of an item, or zero for a nil item. An item
+// that only had its expiration touched keeps the version of the item that was
+// touched, so that reading a key does not conflict with other transactions.
+func (dbi *dbItem) version() uint64 {
+	if dbi == nil {
+		return 0
+	}
+	return dbi.ver
+}
+
+// numTombs is the number of slots for the versions of deleted items.
+const numTombs = 1024
+
+// tombstone records the version of an item that was deleted. Keys share the
+// slots by their hash, which can only make deletedSince report a deletion
+// that did not happen.
+func (db *DB) tombstone(key string, ver uint64) {
+	if db.tombs == nil {
+		// snapshots do not record their deletions.
+		return
+	}
+	slot := &db.tombs[tombSlot(key)]
+	if ver > *slot {
+		*slot = ver
+	}
+}
+
+// deletedSince returns true when an item of the key that was stored after
+// the version may have been deleted.
+func (db *DB) deletedSince(key string, vers uint64) bool {
+	if db.flushver > vers {
+		return true
+	}
+	return db.tombs != nil && db.tombs[tombSlot(key)] > vers
+}
+
+// tombSlot returns the slot of a key for the versions of deleted items.
+func tombSlot(key string) int {
+	// FNV-1a
+	h := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return int(h % numTombs)
+}
 
-	// insert into the rollback map if there has not been a deleteAll.
-	if tx.wc.rbkeys == nil {
-		if prev == nil {
-			// An item with the same key did not previously exist. Let's
-			// create a rollback entry with a nil value. A nil value indicates
-			// that the entry should be deleted on rollback. When the value is
-			// *not* nil, that means the entry should be reverted.
-			if _, ok := tx.wc.rollbackItems[key]; !ok {
-				tx.wc.rollbackItems[key] = nil
-			}
-		} else {
-			// A previous item already exists in the database. Let's create a
-			// rollback entry with the item as the value. We need to check the
-			// map to see if there isn't already an item that matches the
-			// same key.
-			if _, ok := tx.wc.rollbackItems[key]; !ok {
-				tx.wc.rollbackItems[key] = prev
-			}
-			if !prev.expired() {
-				previousValue, replaced = prev.val, true
-			}
-		}
+// hasTouches returns true when there are queued expiration changes.
+func (db *DB) hasTouches() bool {
+	db.touchmu.Lock()
+	defer db.touchmu.Unlock()
+	return len(db.touches) > 0
+}
+
+// landTouches applies the queued expiration changes, if any, before a
+// transaction that does not take the write lock reads the database. The
+// changes are left for later when the write lock is not available right away,
+// such as while other transactions are open.
+func (db *DB) landTouches() {
+	if !db.hasTouches() || !db.mu.TryLock() {
+		return
 	}
-	// For commits we simply assign the item to the map. We use this map to
-	// write the entry to disk.
-	if tx.db.persist {
-		tx.wc.commitItems[key] = item
+	defer db.mu.Unlock()
+	if !db.closed {
+		// a failed write drops the touches, which only costs their refresh.
+		_ = db.applyTouches()
 	}
-	return previousValue, replaced, nil
 }
 
-// Get returns a value for a key. If the item does not exist or if the item
-// has expired then ErrNotFound is returned. If ignoreExpired is true, then
-// the found value will be returned even if it is expired.
-func (tx *Tx) Get(key string, ignoreExpired ...bool) (val string, err error) {
-	if tx.db == nil {
-		return "", ErrTxClosed
+// applyTouches applies the queued expiration changes. Items that were
+// replaced since being read are skipped, but items that expired since being
+// read are still refreshed. The changes are not made by a transaction, so
+// they are not published to OnCommit, change data capture, or notifications,
+// and only the expirations are written to disk. The expirations are written
+// before the items are changed, so that a failed write leaves the database
+// as it was, and the changes are then dropped. The caller must hold the
+// write lock.
+func (db *DB) applyTouches() error {
+	db.touchmu.Lock()
+	touches := db.touches
+	db.touches = nil
+	db.touchmu.Unlock()
+	if len(touches) == 0 {
+		return nil
 	}
-	var ignore bool
-	if len(ignoreExpired) != 0 {
-		ignore = ignoreExpired[0]
+	items := make([]*dbItem, 0, len(touches))
+	for key, t := range touches {
+		prev := db.get(key)
+		if prev == nil || prev != t.item {
+			continue
+		}
+		item := &dbItem{key: key, val: prev.val, ver: prev.ver,
+			opts: &dbItemOpts{ex: true, exat: t.exat}}
+		if prev.opts != nil {
+			item.opts.slide = prev.opts.slide
+		}
+		items = append(items, item)
 	}
-	item := tx.db.get(key)
-	if item == nil || (item.expired() && !ignore) {
-		// The item does not exists or has expired. Let's assume that
-		// the caller is only interested in items that have not expired.
-		return "", ErrNotFound
+	if db.persist && len(items) > 0 {
+		db.buf = db.buf[:0]
+		for _, item := range items {
+			db.buf = item.writeExpireTo(db.buf)
+		}
+		if err := db.flush(); err != nil {
+			return err
+		}
 	}
-	return item.val, nil
+	for _, item := range items {
+		db.insertIntoDatabase(item)
+	}
+	return nil
+}
+
+// GetBytes is the same as Get except that the value is returned as a byte
+// slice without being copied.
+//
+// The returned slice references the memory of the stored item and it must
+// not be modified. Items are never changed in place, so the slice remains
+// valid and unchanged after the transaction closes, even when the key is
+// later replaced or deleted. Use append([]byte(nil), val...) to get a copy
+// that is safe to modify.
+func (tx *Tx) GetBytes(key string, ignoreExpired ...bool) (val []byte,
+	err error) {
+	sval, err := tx.Get(key, ignoreExpired...)
+	if err != nil {
+		return nil, err
+	}
+	return stringBytes(sval), nil
 }
 
 // Delete removes an item from the database based on the item's key. If the item
 // does not exist or if the item has expired then ErrNotFound is returned.
 //
 // Only a writable transaction can be used for this operation.
-// This operation is not allowed during iterations such as Ascend* & Descend*.
+// This operation is not allowed during iterations such as Ascend* & Descend*,
+// unless the DeferIteratingMutations config option is set.
 func (tx *Tx) Delete(key string) (val string, err error) {
 	if tx.db == nil {
 		return "", ErrTxClosed
 	} else if !tx.writable {
 		return "", ErrTxNotWritable
-	} else if tx.wc.itercount > 0 {
+	} else if tx.wc.itercount > 0 && !tx.db.config.DeferIteratingMutations {
 		return "", ErrTxIterating
 	}
-	item := tx.db.deleteFromDatabase(&dbItem{key: key})
-	if item == nil {
-		return "", ErrNotFound
-	}
-	// create a rollback entry if there has not been a deleteAll call.
-	if tx.wc.rbkeys == nil {
-		if _, ok := tx.wc.rollbackItems[key]; !ok {
-			tx.wc.rollbackItems[key] = item
+	var item *dbItem
+	if tx.wc.itercount > 0 {
+		if item = tx.get(key); item != nil {
+			tx.deferItem(key, nil)
 		}
+	} else {
+		item = tx.deleteItem(key)
 	}
-	if tx.db.persist {
-		tx.wc.commitItems[key] = nil
+	if item == nil {
+		return "", ErrNotFound
 	}
 	// Even though the item has been deleted, we still want to check
 	// if it has expired. An expired item should not be returned.
-	if item.expired() {
+	if item.expired(tx.db.now()) {
 		// The item exists in the tree, but has expired. Let's assume that
 		// the caller is only interested in items that have not expired.
 		return "", ErrNotFound
@@ -1616,6 +4504,33 @@ func (tx *Tx) Delete(key string) (val string, err error) {
 	return item.val, nil
 }
 
+// deleteItem removes an item from the database and records the change for
+// rolling back and committing the transaction. Returns the deleted item, or
+// nil if the key was not found.
+func (tx *Tx) deleteItem(key string) *dbItem {
+	tx.observe(key)
+	tx.saveItem(key)
+	delete(tx.wc.ttlonly, key)
+	item := tx.db.deleteFromDatabase(&dbItem{key: key})
+	if item == nil {
+		return nil
+	}
+	// create a rollback entry if there has not been a deleteAll call.
+	if tx.wc.rbkeys == nil {
+		if _, ok := tx.wc.rollbackItems[key]; !ok {
+			tx.wc.rollbackItems[key] = item
+		}
+	}
+	tx.wc.recordCommit(key, nil)
+	tx.wc.changed = true
+	// Only the deletion of an item that existed before the transaction can
+	// be seen by others.
+	if orig := tx.original(key); orig != nil {
+		tx.db.tombstone(key, orig.ver)
+	}
+	return item
+}
+
 // TTL returns the remaining time-to-live for an item.
 // A negative duration will be returned for items that do not have an
 // expiration.
@@ -1623,19 +4538,83 @@ func (tx *Tx) TTL(key string) (time.Duration, error) {
 	if tx.db == nil {
 		return 0, ErrTxClosed
 	}
-	item := tx.db.get(key)
+	tx.observe(key)
+	item := tx.get(key)
 	if item == nil {
 		return 0, ErrNotFound
 	} else if item.opts == nil || !item.opts.ex {
 		return -1, nil
 	}
-	dur := time.Until(item.opts.exat)
+	dur := item.opts.exat.Sub(tx.db.now())
 	if dur < 0 {
 		return 0, ErrNotFound
 	}
 	return dur, nil
 }
 
+// Expire sets the time-to-live of an existing key, without changing its
+// value. Returns ErrNotFound when the key does not exist.
+func (tx *Tx) Expire(key string, ttl time.Duration) error {
+	return tx.expire(key, true, tx.db.now().Add(ttl))
+}
+
+// ExpireAt sets the time that an existing key expires, without changing its
+// value. The time is stored with millisecond precision. Returns ErrNotFound
+// when the key does not exist.
+func (tx *Tx) ExpireAt(key string, t time.Time) error {
+	return tx.expire(key, true, t.Truncate(time.Millisecond))
+}
+
+// Persist removes the time-to-live of an existing key, so that it no longer
+// expires. Returns ErrNotFound when the key does not exist.
+func (tx *Tx) Persist(key string) error {
+	return tx.expire(key, false, time.Time{})
+}
+
+// expire replaces the item of an existing key with one that has the new
+// expiration. When the value has not otherwise changed in the transaction
+// only the expiration is written to disk.
+func (tx *Tx) expire(key string, ex bool, exat time.Time) error {
+	if tx.db == nil {
+		return ErrTxClosed
+	} else if !tx.writable {
+		return ErrTxNotWritable
+	} else if tx.wc.itercount > 0 && !tx.db.config.DeferIteratingMutations {
+		return ErrTxIterating
+	}
+	tx.observe(key)
+	prev := tx.get(key)
+	if prev == nil || prev.expired(tx.db.now()) {
+		return ErrNotFound
+	}
+	if !ex && (prev.opts == nil || !prev.opts.ex) {
+		// nothing to persist
+		return nil
+	}
+	item := &dbItem{key: key, val: prev.val}
+	if ex {
+		item.opts = &dbItemOpts{ex: true, exat: exat}
+		if prev.opts != nil {
+			// a sliding expiration keeps sliding.
+			item.opts.slide = prev.opts.slide
+		}
+	}
+	if tx.wc.itercount > 0 {
+		tx.deferItem(key, item)
+		return nil
+	}
+	_, changed := tx.wc.commitItems[key]
+	ttlonly := !changed || tx.wc.ttlonly[key]
+	tx.setItem(item)
+	if ttlonly && tx.wc.record {
+		if tx.wc.ttlonly == nil {
+			tx.wc.ttlonly = make(map[string]bool)
+		}
+		tx.wc.ttlonly[key] = true
+	}
+	return nil
+}
+
 // scan iterates through a specified index and calls user-defined iterator
 // function for each item encountered.
 // The desc param indicates that the iterator should descend.
@@ -1651,10 +4630,41 @@ func (tx *Tx) scan(desc, gt, lt bool, index, start, stop string,
 	if tx.db == nil {
 		return ErrTxClosed
 	}
+	// create some limit items
+	var itemA, itemB *dbItem
+	if gt || lt {
+		if index == "" {
+			itemA = &dbItem{key: start}
+			itemB = &dbItem{key: stop}
+		} else {
+			itemA = &dbItem{val: start}
+			itemB = &dbItem{val: stop}
+			if desc {
+				itemA.keyless = true
+				itemB.keyless = true
+			}
+		}
+	}
+	return tx.scanPivots(desc, gt, lt, index, itemA, itemB, iterator)
+}
+
+// scanPivots iterates over the items of an index, or of the keys tree when
+// the index is empty, using the pivots as limits. The pivots must be
+// comparable to the items of the tree.
+func (tx *Tx) scanPivots(desc, gt, lt bool, index string,
+	itemA, itemB interface{}, iterator func(key, value string) bool) error {
+	tx.observeScan()
+	var canceled bool
+	// read the clock once for the whole scan.
+	now := tx.db.now()
 	// wrap a btree specific iterator around the user-defined iterator.
 	iter := func(item interface{}) bool {
+		if tx.canceled() {
+			canceled = true
+			return false
+		}
 		dbi := item.(*dbItem)
-		if dbi.expired() {
+		if dbi.expired(now) {
 			return true
 		}
 		return iterator(dbi.key, dbi.val)
@@ -1674,28 +4684,9 @@ func (tx *Tx) scan(desc, gt, lt bool, index, start, stop string,
 			return nil
 		}
 	}
-	// create some limit items
-	var itemA, itemB *dbItem
-	if gt || lt {
-		if index == "" {
-			itemA = &dbItem{key: start}
-			itemB = &dbItem{key: stop}
-		} else {
-			itemA = &dbItem{val: start}
-			itemB = &dbItem{val: stop}
-			if desc {
-				itemA.keyless = true
-				itemB.keyless = true
-			}
-		}
-	}
 	// execute the scan on the underlying tree.
-	if tx.wc != nil {
-		tx.wc.itercount++
-		defer func() {
-			tx.wc.itercount--
-		}()
-	}
+	tx.beginIter()
+	defer tx.endIter()
 	if desc {
 		if gt {
 			if lt {
@@ -1721,9 +4712,157 @@ func (tx *Tx) scan(desc, gt, lt bool, index, start, stop string,
 			btreeAscend(tr, iter)
 		}
 	}
+	if canceled {
+		return tx.canceledErr()
+	}
 	return nil
 }
 
+// Cursor is a pull-based iterator over the items in an index, or over all
+// items ordered by key when the index is an empty string.
+// A Cursor is created with Tx.Cursor and it must be closed when done.
+//
+// A new cursor is not positioned on an item. Use First, Last, or Seek to
+// position it, and then Next and Prev to move it. Expired items are skipped.
+// Once a cursor moves beyond the first or last item, it's no longer
+// positioned on an item and it must be repositioned.
+type Cursor struct {
+	tx   *Tx        // the transaction, nil when closed
+	iter btree.Iter // the underlying b-tree iterator
+	keys bool       // the cursor is over the keys tree
+	item *dbItem    // the current item, nil when not positioned
+}
+
+// Cursor returns a new cursor for the specified index. An empty string for
+// the index means to use the keys, not the values. An invalid index will
+// return an error. A spatial index returns a cursor that has no items.
+//
+// While the cursor is open the transaction is iterating, which means that
+// mutable operations are not allowed, or are deferred until the cursor is
+// closed when the DeferIteratingMutations config option is set.
+func (tx *Tx) Cursor(index string) (*Cursor, error) {
+	if tx.db == nil {
+		return nil, ErrTxClosed
+	}
+	c := &Cursor{tx: tx, keys: index == ""}
+	if index == "" {
+		c.iter = tx.db.keys.Iter()
+	} else {
+		idx := tx.db.idxs[index]
+		if idx == nil {
+			// index was not found. return error
+			return nil, ErrNotFound
+		}
+		if idx.btr != nil {
+			c.iter = idx.btr.Iter()
+		}
+	}
+	tx.observeScan()
+	tx.beginIter()
+	return c, nil
+}
+
+// Close releases the cursor.
+func (c *Cursor) Close() {
+	if c.tx == nil {
+		return
+	}
+	c.iter.Release()
+	if c.tx.db != nil {
+		c.tx.endIter()
+	}
+	c.tx, c.item = nil, nil
+}
+
+// usable returns true when the cursor and its transaction are open.
+func (c *Cursor) usable() bool {
+	if c.tx == nil || c.tx.db == nil {
+		c.item = nil
+		return false
+	}
+	return true
+}
+
+// move positions the cursor after the underlying iterator has moved. Expired
+// items are skipped by calling step.
+func (c *Cursor) move(ok bool, step func() bool) bool {
+	if !ok {
+		c.item = nil
+		return false
+	}
+	now := c.tx.db.now()
+	for ok {
+		dbi := c.iter.Item().(*dbItem)
+		if !dbi.expired(now) {
+			c.item = dbi
+			return true
+		}
+		ok = step()
+	}
+	c.item = nil
+	return false
+}
+
+// First moves the cursor to the first item.
+// Returns false if there are no items.
+func (c *Cursor) First() bool {
+	return c.usable() && c.move(c.iter.First(), c.iter.Next)
+}
+
+// Last moves the cursor to the last item.
+// Returns false if there are no items.
+func (c *Cursor) Last() bool {
+	return c.usable() && c.move(c.iter.Last(), c.iter.Prev)
+}
+
+// Seek moves the cursor to the first item that is greater than or equal to
+// pivot. For the keys the pivot is a key, otherwise it's a value that is
+// compared using the less() function of the index.
+// Returns false if there is no such item.
+func (c *Cursor) Seek(pivot string) bool {
+	if !c.usable() {
+		return false
+	}
+	var ok bool
+	if c.keys {
+		ok = c.iter.Seek(&dbItem{key: pivot})
+	} else {
+		ok = c.iter.Seek(&dbItem{val: pivot})
+	}
+	return c.move(ok, c.iter.Next)
+}
+
+// Next moves the cursor to the next item.
+// Returns false if there is no next item or the cursor is not positioned.
+func (c *Cursor) Next() bool {
+	return c.usable() && c.item != nil && c.move(c.iter.Next(), c.iter.Next)
+}
+
+// Prev moves the cursor to the previous item.
+// Returns false if there is no previous item or the cursor is not
+// positioned.
+func (c *Cursor) Prev() bool {
+	return c.usable() && c.item != nil && c.move(c.iter.Prev(), c.iter.Prev)
+}
+
+// Key returns the key of the current item, or an empty string when the
+// cursor is not positioned.
+func (c *Cursor) Key() string {
+	if c.item == nil {
+		return ""
+	}
+	return c.item.key
+}
+
+// Value returns the value of the current item, or an empty string when the
+// cursor is not positioned.
+func (c *Cursor) Value() string {
+	if c.item == nil {
+		return ""
+	}
+	return c.item.val
+}
+
 // Match returns true if the specified key matches the pattern. This is a very
 // simple pattern matcher where '*' matches on any number characters and '?'
 // matches on any one character.
@@ -1764,6 +4903,16 @@ func (tx *Tx) AscendKeys(pattern string,
 	})
 }
 
+// AscendKeysBytes is the same as AscendKeys except that the iterator receives
+// the values as byte slices. The slices follow the same rules as the value
+// returned from GetBytes and must not be modified.
+func (tx *Tx) AscendKeysBytes(pattern string,
+	iterator func(key string, value []byte) bool) error {
+	return tx.AscendKeys(pattern, func(key, value string) bool {
+		return iterator(key, stringBytes(value))
+	})
+}
+
 // DescendKeys allows for iterating through keys based on the specified pattern.
 func (tx *Tx) DescendKeys(pattern string,
 	iterator func(key, value string) bool) error {
@@ -1808,6 +4957,16 @@ func (tx *Tx) Ascend(index string,
 	return tx.scan(false, false, false, index, "", "", iterator)
 }
 
+// AscendBytes is the same as Ascend except that the iterator receives the
+// values as byte slices. The slices follow the same rules as the value
+// returned from GetBytes and must not be modified.
+func (tx *Tx) AscendBytes(index string,
+	iterator func(key string, value []byte) bool) error {
+	return tx.Ascend(index, func(key, value string) bool {
+		return iterator(key, stringBytes(value))
+	})
+}
+
 // AscendGreaterOrEqual calls the iterator for every item in the database within
 // the range [pivot, last], until iterator returns false.
 // When an index is provided, the results will be ordered by the item values
@@ -1843,6 +5002,36 @@ func (tx *Tx) AscendRange(index, greaterOrEqual, lessThan string,
 	)
 }
 
+// AscendCompositeRange calls the iterator for every item in a composite
+// index within the range [greaterOrEqual, lessThan), until iterator returns
+// false. The pivots are tuples of field values, in the order of the fields
+// of the index. A tuple may have fewer values than the index has fields, in
+// which case it's a prefix: a greaterOrEqual prefix starts at the first item
+// with those leading fields, and a lessThan prefix includes all of the items
+// with those leading fields. For example, with the fields status and created,
+// []string{"active", "100"} and []string{"active", "200"} finds the active
+// items that were created in [100, 200), and []string{"active"} for both
+// pivots finds all of the active items.
+// An invalid index, or one that is not a composite index, will return an
+// error.
+func (tx *Tx) AscendCompositeRange(index string, greaterOrEqual,
+	lessThan []string, iterator func(key, value string) bool) error {
+	if tx.db == nil {
+		return ErrTxClosed
+	}
+	idx := tx.db.idxs[index]
+	if idx == nil {
+		return ErrNotFound
+	}
+	if idx.fields == nil || len(greaterOrEqual) > len(idx.fields) ||
+		len(lessThan) > len(idx.fields) {
+		return ErrInvalidOperation
+	}
+	return tx.scanPivots(false, true, true, index,
+		&tuplePivot{fields: greaterOrEqual},
+		&tuplePivot{fields: lessThan, high: true}, iterator)
+}
+
 // Descend calls the iterator for every item in the database within the range
 // [last, first], until iterator returns false.
 // When an index is provided, the results will be ordered by the item values
@@ -1972,8 +5161,13 @@ func (tx *Tx) Nearby(index, bounds string,
 		// cannot search on keys tree. just return nil.
 		return nil
 	}
-	// // wrap a rtree specific iterator around the user-defined iterator.
+	var canceled bool
+	// wrap a rtree specific iterator around the user-defined iterator.
 	iter := func(item rtred.Item, dist float64) bool {
+		if tx.canceled() {
+			canceled = true
+			return false
+		}
 		dbi := item.(*dbItem)
 		return iterator(dbi.key, dbi.val, dist)
 	}
@@ -1982,17 +5176,19 @@ func (tx *Tx) Nearby(index, bounds string,
 		// index was not found. return error
 		return ErrNotFound
 	}
-	if idx.rtr == nil {
+	tx.observeScan()
+	rtr := idx.spatial()
+	if rtr == nil {
 		// not an r-tree index. just return nil
 		return nil
 	}
 	// execute the nearby search
-	var min, max []float64
-	if idx.rect != nil {
-		min, max = idx.rect(bounds)
-	}
+	min, max := idx.rect(bounds)
 	// set the center param to false, which uses the box dist calc.
-	idx.rtr.KNN(&rect{min, max}, false, iter)
+	rtr.KNN(&rect{min, max}, false, iter)
+	if canceled {
+		return tx.canceledErr()
+	}
 	return nil
 }
 
@@ -2010,8 +5206,13 @@ func (tx *Tx) Intersects(index, bounds string,
 		// cannot search on keys tree. just return nil.
 		return nil
 	}
+	var canceled bool
 	// wrap a rtree specific iterator around the user-defined iterator.
 	iter := func(item rtred.Item) bool {
+		if tx.canceled() {
+			canceled = true
+			return false
+		}
 		dbi := item.(*dbItem)
 		return iterator(dbi.key, dbi.val)
 	}
@@ -2020,24 +5221,82 @@ func (tx *Tx) Intersects(index, bounds string,
 		// index was not found. return error
 		return ErrNotFound
 	}
-	if idx.rtr == nil {
+	tx.observeScan()
+	rtr := idx.spatial()
+	if rtr == nil {
 		// not an r-tree index. just return nil
 		return nil
 	}
 	// execute the search
-	var min, max []float64
-	if idx.rect != nil {
-		min, max = idx.rect(bounds)
+	min, max := idx.rect(bounds)
+	rtr.Search(&rect{min, max}, iter)
+	if canceled {
+		return tx.canceledErr()
+	}
+	return nil
+}
+
+// AscendExpiring calls the iterator for every item that expires at or after
+// the pivot, in order of expiration. Items that do not expire, and items
+// that have already expired, are skipped. Return false from the iterator to
+// stop.
+func (tx *Tx) AscendExpiring(pivot time.Time,
+	iterator func(key, value string, exp time.Time) bool) error {
+	if tx.db == nil {
+		return ErrTxClosed
+	}
+	tx.observeScan()
+	if now := tx.db.now(); now.After(pivot) {
+		pivot = now
+	}
+	var canceled bool
+	iter := func(item interface{}) bool {
+		if tx.canceled() {
+			canceled = true
+			return false
+		}
+		dbi := item.(*dbItem)
+		return iterator(dbi.key, dbi.val, dbi.opts.exat)
+	}
+	tx.beginIter()
+	defer tx.endIter()
+	btreeAscendGreaterOrEqual(tx.db.exps, &dbItem{
+		opts: &dbItemOpts{ex: true, exat: pivot},
+	}, iter)
+	if canceled {
+		return tx.canceledErr()
 	}
-	idx.rtr.Search(&rect{min, max}, iter)
 	return nil
 }
 
+// ExpiringBefore returns the number of items that expire before the provided
+// time. Items that have already expired are not counted.
+func (tx *Tx) ExpiringBefore(t time.Time) (int, error) {
+	if tx.db == nil {
+		return 0, ErrTxClosed
+	}
+	tx.observeScan()
+	now := tx.db.now()
+	if !t.After(now) {
+		return 0, nil
+	}
+	// count by binary search, rather than visiting the items.
+	n := btreeCountLessThan(tx.db.exps,
+		&dbItem{opts: &dbItemOpts{ex: true, exat: t}}) -
+		btreeCountLessThan(tx.db.exps,
+			&dbItem{opts: &dbItemOpts{ex: true, exat: now}})
+	if n < 0 {
+		n = 0
+	}
+	return n, nil
+}
+
 // Len returns the number of items in the database
 func (tx *Tx) Len() (int, error) {
 	if tx.db == nil {
 		return 0, ErrTxClosed
 	}
+	tx.observeScan()
 	return tx.db.keys.Len(), nil
 }
 
@@ -2066,7 +5325,7 @@ type IndexOptions struct {
 // IndexString, IndexBinary, etc.
 func (tx *Tx) CreateIndex(name, pattern string,
 	less ...func(a, b string) bool) error {
-	return tx.createIndex(name, pattern, less, nil, nil)
+	return tx.createIndex(name, pattern, less, nil, nil, nil)
 }
 
 // CreateIndexOptions is the same as CreateIndex except that it allows
@@ -2074,7 +5333,7 @@ func (tx *Tx) CreateIndex(name, pattern string,
 func (tx *Tx) CreateIndexOptions(name, pattern string,
 	opts *IndexOptions,
 	less ...func(a, b string) bool) error {
-	return tx.createIndex(name, pattern, less, nil, opts)
+	return tx.createIndex(name, pattern, less, nil, nil, opts)
 }
 
 // CreateSpatialIndex builds a new index and populates it with items.
@@ -2093,7 +5352,7 @@ func (tx *Tx) CreateIndexOptions(name, pattern string,
 // parameter.
 func (tx *Tx) CreateSpatialIndex(name, pattern string,
 	rect func(item string) (min, max []float64)) error {
-	return tx.createIndex(name, pattern, nil, rect, nil)
+	return tx.createIndex(name, pattern, nil, rect, nil, nil)
 }
 
 // CreateSpatialIndexOptions is the same as CreateSpatialIndex except that
@@ -2101,13 +5360,42 @@ func (tx *Tx) CreateSpatialIndex(name, pattern string,
 func (tx *Tx) CreateSpatialIndexOptions(name, pattern string,
 	opts *IndexOptions,
 	rect func(item string) (min, max []float64)) error {
-	return tx.createIndex(name, pattern, nil, rect, nil)
+	return tx.createIndex(name, pattern, nil, rect, nil, nil)
+}
+
+// CreateCompositeIndex builds a new index over several fields that are
+// extracted from the values, and populates it with items. The items are
+// ordered by the first field, then by the second field, and so on.
+// An error will occur if an index with the same name already exists, or
+// when there are no fields.
+//
+// A composite index can be used with all of the Ascend* and Descend*
+// methods, and also with AscendCompositeRange, which takes the pivots as
+// tuples of field values.
+func (tx *Tx) CreateCompositeIndex(name, pattern string,
+	fields ...IndexField) error {
+	if len(fields) == 0 {
+		return ErrInvalidOperation
+	}
+	fields = append([]IndexField(nil), fields...)
+	lessers := make([]func(a, b string) bool, len(fields))
+	for i := range fields {
+		if fields[i].Less == nil {
+			fields[i].Less = IndexString
+		}
+		field := fields[i]
+		lessers[i] = func(a, b string) bool {
+			return field.Less(field.Extract(a), field.Extract(b))
+		}
+	}
+	return tx.createIndex(name, pattern, lessers, nil, fields, nil)
 }
 
 // createIndex is called by CreateIndex() and CreateSpatialIndex()
 func (tx *Tx) createIndex(name string, pattern string,
 	lessers []func(a, b string) bool,
 	rect func(item string) (min, max []float64),
+	fields []IndexField,
 	opts *IndexOptions,
 ) error {
 	if tx.db == nil {
@@ -2116,6 +5404,8 @@ func (tx *Tx) createIndex(name string, pattern string,
 		return ErrTxNotWritable
 	} else if tx.wc.itercount > 0 {
 		return ErrTxIterating
+	} else if tx.occ != nil {
+		return ErrInvalidOperation
 	}
 	if name == "" {
 		// cannot create an index without a name.
@@ -2162,11 +5452,13 @@ func (tx *Tx) createIndex(name string, pattern string,
 		pattern: pattern,
 		less:    less,
 		rect:    rect,
+		fields:  fields,
 		db:      tx.db,
 		opts:    sopts,
 	}
 	idx.rebuild()
 	// save the index
+	tx.saveIndex(name)
 	tx.db.idxs[name] = idx
 	if tx.wc.rbkeys == nil {
 		// store the index in the rollback map.
@@ -2187,6 +5479,8 @@ func (tx *Tx) DropIndex(name string) error {
 		return ErrTxNotWritable
 	} else if tx.wc.itercount > 0 {
 		return ErrTxIterating
+	} else if tx.occ != nil {
+		return ErrInvalidOperation
 	}
 	if name == "" {
 		// cannot drop the default "keys" index
@@ -2198,6 +5492,7 @@ func (tx *Tx) DropIndex(name string) error {
 	}
 	// delete from the map.
 	// this is all that is needed to delete an index.
+	tx.saveIndex(name)
 	delete(tx.db.idxs, name)
 	if tx.wc.rbkeys == nil {
 		// store the index in the rollback map.
@@ -2335,6 +5630,26 @@ func IndexJSONCaseSensitive(path string) func(a, b string) bool {
 	}
 }
 
+// IndexField is a field of a composite index.
+type IndexField struct {
+	// Extract returns the field from a value.
+	Extract func(value string) string
+	// Less compares two fields. The default is IndexString.
+	Less func(a, b string) bool
+}
+
+// IndexJSONField provides a composite index field for any JSON field. The
+// less function compares the string form of the field, such as IndexString
+// or IndexInt, and the default is IndexString.
+func IndexJSONField(path string, less func(a, b string) bool) IndexField {
+	return IndexField{
+		Extract: func(value string) string {
+			return gjson.Get(value, path).String()
+		},
+		Less: less,
+	}
+}
+
 // Desc is a helper function that changes the order of an index.
 func Desc(less func(a, b string) bool) func(a, b string) bool {
 	return func(a, b string) bool { return less(b, a) }
@@ -2362,6 +5677,21 @@ func btreeAscendLessThan(tr *btree.BTree, pivot interface{},
 	})
 }
 
+// btreeCountLessThan returns the number of items that are less than the
+// pivot, using a binary search over the positions of the items.
+func btreeCountLessThan(tr *btree.BTree, pivot interface{}) int {
+	lo, hi := 0, tr.Len()
+	for lo < hi {
+		mid := int(uint(lo+hi) >> 1)
+		if bLT(tr, tr.GetAt(mid), pivot) {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo
+}
+
 func btreeAscendGreaterOrEqual(tr *btree.BTree, pivot interface{},
 	iter func(item interface{}) bool,
 ) {
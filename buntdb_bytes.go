@@ -0,0 +1,14 @@
+//go:build go1.20
+
+package buntdb
+
+import "unsafe"
+
+// stringBytes returns the bytes of a string without making a copy.
+// The returned slice must not be modified.
+func stringBytes(s string) []byte {
+	if s == "" {
+		return []byte{}
+	}
+	return unsafe.Slice(unsafe.StringData(s), len(s))
+}
@@ -0,0 +1,9 @@
+//go:build !go1.20
+
+package buntdb
+
+// stringBytes returns the bytes of a string. Prior to Go 1.20 there's no
+// safe way to do this without making a copy.
+func stringBytes(s string) []byte {
+	return []byte(s)
+}
@@ -0,0 +1,45 @@
+//go:build go1.23
+
+package buntdb
+
+import "iter"
+
+// All returns an iterator over the items of the cursor in ascending order,
+// starting with the first item. It's intended for range-over-func loops.
+//
+//	for key, value := range c.All() {
+//		...
+//	}
+func (c *Cursor) All() iter.Seq2[string, string] {
+	return func(yield func(key, value string) bool) {
+		for ok := c.First(); ok; ok = c.Next() {
+			if !yield(c.Key(), c.Value()) {
+				return
+			}
+		}
+	}
+}
+
+// Backward returns an iterator over the items of the cursor in descending
+// order, starting with the last item.
+func (c *Cursor) Backward() iter.Seq2[string, string] {
+	return func(yield func(key, value string) bool) {
+		for ok := c.Last(); ok; ok = c.Prev() {
+			if !yield(c.Key(), c.Value()) {
+				return
+			}
+		}
+	}
+}
+
+// From returns an iterator over the items of the cursor in ascending order,
+// starting with the first item that is greater than or equal to pivot.
+func (c *Cursor) From(pivot string) iter.Seq2[string, string] {
+	return func(yield func(key, value string) bool) {
+		for ok := c.Seek(pivot); ok; ok = c.Next() {
+			if !yield(c.Key(), c.Value()) {
+				return
+			}
+		}
+	}
+}
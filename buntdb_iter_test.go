@@ -0,0 +1,52 @@
+//go:build go1.23
+
+package buntdb
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/tidwall/assert"
+)
+
+func TestCursorSeq(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	assert.Assert(db.Update(func(tx *Tx) error {
+		for i := 0; i < 5; i++ {
+			key := fmt.Sprintf("key:%d", i)
+			if _, _, err := tx.Set(key, fmt.Sprint(i), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	}) == nil)
+	assert.Assert(db.View(func(tx *Tx) error {
+		c, err := tx.Cursor("")
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		var res []string
+		for key, value := range c.All() {
+			res = append(res, key+"="+value)
+		}
+		assert.Assert(strings.Join(res, ",") ==
+			"key:0=0,key:1=1,key:2=2,key:3=3,key:4=4")
+		res = res[:0]
+		for key := range c.Backward() {
+			if key == "key:1" {
+				break
+			}
+			res = append(res, key)
+		}
+		assert.Assert(strings.Join(res, ",") == "key:4,key:3,key:2")
+		res = res[:0]
+		for key := range c.From("key:3") {
+			res = append(res, key)
+		}
+		assert.Assert(strings.Join(res, ",") == "key:3,key:4")
+		return nil
+	}) == nil)
+}
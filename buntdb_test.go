@@ -2,9 +2,11 @@ package buntdb
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"math/rand"
 	"os"
 	"strconv"
@@ -188,6 +190,90 @@ func TestMutatingIterator(t *testing.T) {
 	}
 }
 
+func TestDeferIteratingMutations(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	var config Config
+	assert.Assert(db.ReadConfig(&config) == nil)
+	config.DeferIteratingMutations = true
+	assert.Assert(db.SetConfig(config) == nil)
+	assert.Assert(db.CreateIndex("ages", "user:*:age", IndexInt) == nil)
+	assert.Assert(db.Update(func(tx *Tx) error {
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("user:%03d:age", i)
+			if _, _, err := tx.Set(key, strconv.Itoa(i%10), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	}) == nil)
+	assert.Assert(db.Update(func(tx *Tx) error {
+		var n int
+		err := tx.Ascend("ages", func(key, val string) bool {
+			n++
+			if val == "0" {
+				v, err := tx.Delete(key)
+				assert.Assert(err == nil && v == "0")
+				_, err = tx.Delete(key)
+				assert.Assert(err == ErrNotFound)
+				_, err = tx.Get(key)
+				assert.Assert(err == ErrNotFound)
+			} else if val == "9" {
+				prev, replaced, err := tx.Set(key, "10", nil)
+				assert.Assert(err == nil && replaced && prev == "9")
+				prev, replaced, err = tx.Set(key, "11", nil)
+				assert.Assert(err == nil && replaced && prev == "10")
+				// nested iterations do not apply the mutations
+				err = tx.AscendKeys(key, func(key, val string) bool {
+					assert.Assert(val == "9")
+					return true
+				})
+				assert.Assert(err == nil)
+			}
+			assert.Assert(tx.CreateIndex("other", "*", IndexString) ==
+				ErrTxIterating)
+			return true
+		})
+		assert.Assert(err == nil && n == 100)
+		// the mutations are applied when the iteration completes
+		n = 0
+		err = tx.Ascend("ages", func(key, val string) bool {
+			assert.Assert(val != "0" && val != "9")
+			n++
+			return true
+		})
+		assert.Assert(err == nil && n == 90)
+		val, err := tx.Get("user:009:age")
+		assert.Assert(err == nil && val == "11")
+		return nil
+	}) == nil)
+
+	// deferred mutations are committed and rolled back like any other
+	db = testReOpen(t, db)
+	assert.Assert(db.ReadConfig(&config) == nil)
+	config.DeferIteratingMutations = true
+	assert.Assert(db.SetConfig(config) == nil)
+	err := db.Update(func(tx *Tx) error {
+		err := tx.AscendKeys("user:*", func(key, val string) bool {
+			_, err := tx.Delete(key)
+			assert.Assert(err == nil)
+			return true
+		})
+		assert.Assert(err == nil)
+		n, err := tx.Len()
+		assert.Assert(err == nil && n == 0)
+		return errors.New("rollback")
+	})
+	assert.Assert(err.Error() == "rollback")
+	assert.Assert(db.View(func(tx *Tx) error {
+		n, err := tx.Len()
+		assert.Assert(err == nil && n == 90)
+		val, err := tx.Get("user:019:age")
+		assert.Assert(err == nil && val == "11")
+		return nil
+	}) == nil)
+}
+
 func TestCaseInsensitiveIndex(t *testing.T) {
 	db := testOpen(t)
 	defer testClose(db)
@@ -1395,6 +1481,14 @@ func TestDatabaseFormat(t *testing.T) {
 	testFormat(t, true, "*2\r\n$3\r\nDEL\r\n$5\r\nHELLO\r\n", nil)
 	testFormat(t, true, "*3\r\n$3\r\nSET\r\n$5\r\nHELLO\r\n$5\r\nWORLD\r\n", nil)
 	testFormat(t, true, "*1\r\n$7\r\nFLUSHDB\r\n", nil)
+	testFormat(t, true, "*5\r\n$3\r\nSET\r\n$5\r\nHELLO\r\n$5\r\nWORLD\r\n$2\r\nPX\r\n$5\r\n10000\r\n", nil)
+	testFormat(t, true, "*5\r\n$3\r\nSET\r\n$5\r\nHELLO\r\n$5\r\nWORLD\r\n$4\r\nPXAT\r\n$13\r\n1000000000000\r\n", nil)
+	testFormat(t, false, "*5\r\n$3\r\nSET\r\n$5\r\nHELLO\r\n$5\r\nWORLD\r\n$2\r\nXX\r\n$2\r\n10\r\n", nil)
+	testFormat(t, true, "*3\r\n$9\r\nPEXPIREAT\r\n$5\r\nHELLO\r\n$13\r\n1000000000000\r\n", nil)
+	testFormat(t, true, "*2\r\n$7\r\nPERSIST\r\n$5\r\nHELLO\r\n", nil)
+	testFormat(t, true, "*7\r\n$3\r\nSET\r\n$5\r\nHELLO\r\n$5\r\nWORLD\r\n$2\r\nPX\r\n$5\r\n10000\r\n$7\r\nSLIDING\r\n$5\r\n10000\r\n", nil)
+	testFormat(t, false, "*7\r\n$3\r\nSET\r\n$5\r\nHELLO\r\n$5\r\nWORLD\r\n$2\r\nPX\r\n$5\r\n10000\r\n$5\r\nSLIDE\r\n$5\r\n10000\r\n", nil)
+	testFormat(t, false, "*2\r\n$9\r\nPEXPIREAT\r\n$5\r\nHELLO\r\n", nil)
 
 	// commands with invalid names or arguments
 	testFormat(t, false, "*3\r\n$3\r\nDEL\r\n$5\r\nHELLO\r\n$5\r\nWORLD\r\n", nil)
@@ -2427,6 +2521,78 @@ func Benchmark_Set_NoPersist_Sequential_100(t *testing.B) {
 	benchSetGet(t, true, false, false, 100)
 }
 
+// Batch
+// benchBatch loads t.N keys with a single Batch, or with a single Update
+// transaction as a baseline.
+func benchBatch(t *testing.B, batch, persist, random bool) {
+	var db *DB
+	var err error
+	if persist {
+		db = testOpen(t)
+		defer testClose(db)
+	} else {
+		db, err = Open(":memory:")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+	}
+	keys := make([]string, t.N)
+	for i := range keys {
+		n := i
+		if random {
+			n = rand.Int()
+		}
+		keys[i] = fmt.Sprintf("key:%016d", n)
+	}
+	t.ResetTimer()
+	if batch {
+		b := db.Batch()
+		for _, key := range keys {
+			if err := b.Set(key, "value", nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = b.Commit()
+	} else {
+		err = db.Update(func(tx *Tx) error {
+			for _, key := range keys {
+				if _, _, err := tx.Set(key, "value", nil); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+func Benchmark_Batch_Persist_Random(t *testing.B) {
+	benchBatch(t, true, true, true)
+}
+func Benchmark_Batch_Persist_Sequential(t *testing.B) {
+	benchBatch(t, true, true, false)
+}
+func Benchmark_Batch_NoPersist_Random(t *testing.B) {
+	benchBatch(t, true, false, true)
+}
+func Benchmark_Batch_NoPersist_Sequential(t *testing.B) {
+	benchBatch(t, true, false, false)
+}
+func Benchmark_BatchUpdate_Persist_Random(t *testing.B) {
+	benchBatch(t, false, true, true)
+}
+func Benchmark_BatchUpdate_Persist_Sequential(t *testing.B) {
+	benchBatch(t, false, true, false)
+}
+func Benchmark_BatchUpdate_NoPersist_Random(t *testing.B) {
+	benchBatch(t, false, false, true)
+}
+func Benchmark_BatchUpdate_NoPersist_Sequential(t *testing.B) {
+	benchBatch(t, false, false, false)
+}
+
 // Get
 func Benchmark_Get_1(t *testing.B) {
 	benchSetGet(t, false, false, false, 1)
@@ -2695,7 +2861,10 @@ func TestOnExpiredSync(t *testing.T) {
 	}
 
 	done := make(chan struct{})
+	exited := make(chan struct{})
+	defer func() { <-exited }()
 	go func() {
+		defer close(exited)
 		ticks := time.NewTicker(time.Millisecond * 50)
 		defer ticks.Stop()
 		for {
@@ -2958,3 +3127,2211 @@ func TestIssue112(t *testing.T) {
 		return err
 	})
 }
+
+func TestBytes(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	buf := []byte("hello")
+	err := db.Update(func(tx *Tx) error {
+		if _, _, err := tx.SetBytes("key:1", buf, nil); err != nil {
+			return err
+		}
+		// the database must hold a copy of the value
+		buf[0] = 'j'
+		prev, replaced, err := tx.SetBytes("key:2", []byte("world"), nil)
+		if err != nil {
+			return err
+		}
+		assert.Assert(!replaced && prev == nil)
+		prev, replaced, err = tx.SetBytes("key:2", []byte("planet"), nil)
+		if err != nil {
+			return err
+		}
+		assert.Assert(replaced && string(prev) == "world")
+		_, _, err = tx.SetBytes("key:3", nil, nil)
+		return err
+	})
+	assert.Assert(err == nil)
+	err = db.View(func(tx *Tx) error {
+		val, err := tx.GetBytes("key:1")
+		if err != nil {
+			return err
+		}
+		assert.Assert(string(val) == "hello")
+		val, err = tx.GetBytes("key:3")
+		if err != nil {
+			return err
+		}
+		assert.Assert(val != nil && len(val) == 0)
+		_, err = tx.GetBytes("key:4")
+		assert.Assert(err == ErrNotFound)
+		var res []string
+		err = tx.AscendBytes("", func(key string, value []byte) bool {
+			res = append(res, key+"="+string(value))
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		assert.Assert(strings.Join(res, ",") ==
+			"key:1=hello,key:2=planet,key:3=")
+		res = res[:0]
+		err = tx.AscendKeysBytes("key:?", func(key string, value []byte) bool {
+			res = append(res, key+"="+string(value))
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		assert.Assert(strings.Join(res, ",") ==
+			"key:1=hello,key:2=planet,key:3=")
+		return nil
+	})
+	assert.Assert(err == nil)
+}
+
+func TestSnapshot(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	err := db.Update(func(tx *Tx) error {
+		if err := tx.CreateIndex("vals", "*", IndexString); err != nil {
+			return err
+		}
+		if err := tx.CreateSpatialIndex("pts", "pt:*", IndexRect); err != nil {
+			return err
+		}
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("key:%03d", i)
+			if _, _, err := tx.Set(key, fmt.Sprint(i), nil); err != nil {
+				return err
+			}
+		}
+		_, _, err := tx.Set("pt:1", Point(10, 10), nil)
+		return err
+	})
+	assert.Assert(err == nil)
+	tx, err := db.BeginSnapshot()
+	assert.Assert(err == nil)
+	_, _, err = tx.Set("key:000", "x", nil)
+	assert.Assert(err == ErrTxNotWritable)
+	assert.Assert(tx.Commit() == ErrTxNotWritable)
+
+	// writers must not be blocked by the open snapshot
+	err = db.Update(func(tx *Tx) error {
+		if _, _, err := tx.Set("key:000", "changed", nil); err != nil {
+			return err
+		}
+		if _, err := tx.Delete("key:001"); err != nil {
+			return err
+		}
+		if _, _, err := tx.Set("pt:2", Point(10, 10), nil); err != nil {
+			return err
+		}
+		return tx.DropIndex("vals")
+	})
+	assert.Assert(err == nil)
+
+	// the snapshot still sees the database as it was
+	val, err := tx.Get("key:000")
+	assert.Assert(err == nil && val == "0")
+	val, err = tx.Get("key:001")
+	assert.Assert(err == nil && val == "1")
+	n, err := tx.Len()
+	assert.Assert(err == nil && n == 101)
+	var count int
+	err = tx.Ascend("vals", func(key, value string) bool {
+		count++
+		return true
+	})
+	assert.Assert(err == nil && count == 101)
+	var pts []string
+	err = tx.Intersects("pts", "[0 0],[20 20]", func(key, value string) bool {
+		pts = append(pts, key)
+		return true
+	})
+	assert.Assert(err == nil && len(pts) == 1 && pts[0] == "pt:1")
+	assert.Assert(tx.Rollback() == nil)
+
+	// new snapshots see the changes
+	err = db.ViewSnapshot(func(tx *Tx) error {
+		val, err := tx.Get("key:000")
+		assert.Assert(err == nil && val == "changed")
+		_, err = tx.Get("key:001")
+		assert.Assert(err == ErrNotFound)
+		err = tx.Ascend("vals", func(key, value string) bool { return true })
+		assert.Assert(err == ErrNotFound)
+		var pts int
+		err = tx.Intersects("pts", "[0 0],[20 20]", func(key, value string) bool {
+			pts++
+			return true
+		})
+		assert.Assert(err == nil && pts == 2)
+		return nil
+	})
+	assert.Assert(err == nil)
+
+	// scan a snapshot while another goroutine keeps writing
+	tx, err = db.BeginSnapshot()
+	assert.Assert(err == nil)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			err := db.Update(func(tx *Tx) error {
+				_, _, err := tx.Set(fmt.Sprintf("key:%03d", i), "w", nil)
+				return err
+			})
+			assert.Assert(err == nil)
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		err = tx.Ascend("", func(key, value string) bool {
+			assert.Assert(value != "w")
+			return true
+		})
+		assert.Assert(err == nil)
+	}
+	wg.Wait()
+	assert.Assert(tx.Rollback() == nil)
+	testClose(db)
+	_, err = db.BeginSnapshot()
+	assert.Assert(err == ErrDatabaseClosed)
+}
+
+func TestOptimistic(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	err := db.Update(func(tx *Tx) error {
+		_, _, err := tx.Set("a", "1", nil)
+		if err != nil {
+			return err
+		}
+		_, _, err = tx.Set("b", "1", nil)
+		return err
+	})
+	assert.Assert(err == nil)
+
+	// disjoint keys do not conflict
+	tx1, err := db.BeginOptimistic()
+	assert.Assert(err == nil)
+	tx2, err := db.BeginOptimistic()
+	assert.Assert(err == nil)
+	_, _, err = tx1.Set("a", "2", nil)
+	assert.Assert(err == nil)
+	val, err := tx1.Get("a")
+	assert.Assert(err == nil && val == "2")
+	_, _, err = tx2.Set("b", "2", nil)
+	assert.Assert(err == nil)
+	assert.Assert(tx1.Commit() == nil)
+	assert.Assert(tx2.Commit() == nil)
+
+	// a key that was read and then changed by another tx conflicts
+	tx1, err = db.BeginOptimistic()
+	assert.Assert(err == nil)
+	val, err = tx1.Get("a")
+	assert.Assert(err == nil && val == "2")
+	err = db.Update(func(tx *Tx) error {
+		_, _, err := tx.Set("a", "3", nil)
+		return err
+	})
+	assert.Assert(err == nil)
+	_, _, err = tx1.Set("b", "3", nil)
+	assert.Assert(err == nil)
+	assert.Assert(tx1.Commit() == ErrConflict)
+	assert.Assert(tx1.Commit() == ErrTxClosed)
+
+	// scans conflict with any change to the database
+	tx1, err = db.BeginOptimistic()
+	assert.Assert(err == nil)
+	assert.Assert(tx1.Ascend("", func(key, value string) bool {
+		return true
+	}) == nil)
+	assert.Assert(db.Update(func(tx *Tx) error {
+		_, _, err := tx.Set("c", "1", nil)
+		return err
+	}) == nil)
+	assert.Assert(tx1.Commit() == ErrConflict)
+
+	// deleting conflicts with a concurrent set
+	tx1, err = db.BeginOptimistic()
+	assert.Assert(err == nil)
+	_, err = tx1.Delete("c")
+	assert.Assert(err == nil)
+	assert.Assert(db.Update(func(tx *Tx) error {
+		_, _, err := tx.Set("c", "2", nil)
+		return err
+	}) == nil)
+	assert.Assert(tx1.Commit() == ErrConflict)
+
+	// rolled back changes are discarded
+	tx1, err = db.BeginOptimistic()
+	assert.Assert(err == nil)
+	_, err = tx1.Delete("c")
+	assert.Assert(err == nil)
+	assert.Assert(tx1.CreateIndex("idx", "*", IndexString) == ErrInvalidOperation)
+	assert.Assert(tx1.DeleteAll() == ErrInvalidOperation)
+	assert.Assert(tx1.Rollback() == nil)
+	assert.Assert(db.View(func(tx *Tx) error {
+		val, err := tx.Get("c")
+		assert.Assert(err == nil && val == "2")
+		return nil
+	}) == nil)
+
+	// concurrent increments with retries
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				err := db.UpdateRetry(func(tx *Tx) error {
+					val, err := tx.Get("counter")
+					if err != nil && err != ErrNotFound {
+						return err
+					}
+					n, _ := strconv.Atoi(val)
+					_, _, err = tx.Set("counter", strconv.Itoa(n+1), nil)
+					return err
+				}, 1000)
+				assert.Assert(err == nil)
+			}
+		}()
+	}
+	wg.Wait()
+	db = testReOpen(t, db)
+	assert.Assert(db.View(func(tx *Tx) error {
+		val, err := tx.Get("counter")
+		assert.Assert(err == nil && val == "400")
+		val, err = tx.Get("b")
+		assert.Assert(err == nil && val == "2")
+		return nil
+	}) == nil)
+
+	// a single attempt reports the conflict
+	attempts := 0
+	err = db.UpdateRetry(func(tx *Tx) error {
+		attempts++
+		if _, err := tx.Get("a"); err != nil {
+			return err
+		}
+		return db.Update(func(tx *Tx) error {
+			_, _, err := tx.Set("a", "4", nil)
+			return err
+		})
+	}, 0)
+	assert.Assert(err == ErrConflict && attempts == 1)
+}
+
+func TestContext(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	assert.Assert(db.Update(func(tx *Tx) error {
+		if err := tx.CreateSpatialIndex("pts", "pt:*", IndexRect); err != nil {
+			return err
+		}
+		for i := 0; i < 100; i++ {
+			key := fmt.Sprintf("pt:%03d", i)
+			if _, _, err := tx.Set(key, Point(float64(i), 0), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	}) == nil)
+
+	// a context that can never be canceled is not checked
+	assert.Assert(db.View(func(tx *Tx) error {
+		assert.Assert(tx.ctx == nil)
+		return nil
+	}) == nil)
+
+	// a stuck writer
+	wtx, err := db.Begin(true)
+	assert.Assert(err == nil)
+	ctx, cancel := context.WithTimeout(context.Background(),
+		time.Millisecond*50)
+	err = db.UpdateContext(ctx, func(tx *Tx) error { return nil })
+	cancel()
+	assert.Assert(err == context.DeadlineExceeded)
+	ctx, cancel = context.WithTimeout(context.Background(),
+		time.Millisecond*50)
+	err = db.ViewContext(ctx, func(tx *Tx) error { return nil })
+	cancel()
+	assert.Assert(err == context.DeadlineExceeded)
+	assert.Assert(wtx.Rollback() == nil)
+
+	// the abandoned lock waits must not keep the database locked
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.Assert(db.UpdateContext(ctx, func(tx *Tx) error {
+		return nil
+	}) == nil)
+
+	// canceled contexts do not begin
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = db.BeginContext(ctx, false)
+	assert.Assert(err == context.Canceled)
+
+	// iterations stop when the context is canceled
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	err = db.ViewContext(ctx, func(tx *Tx) error {
+		var n int
+		err := tx.Ascend("", func(key, value string) bool {
+			n++
+			if n == 10 {
+				cancel()
+			}
+			return true
+		})
+		assert.Assert(err == context.Canceled && n == 10)
+		n = 0
+		err = tx.Intersects("pts", "[-inf],[+inf]", func(key, value string) bool {
+			n++
+			return true
+		})
+		assert.Assert(err == context.Canceled && n == 0)
+		err = tx.Nearby("pts", "[0 0]", func(key, value string, dist float64) bool {
+			n++
+			return true
+		})
+		assert.Assert(err == context.Canceled && n == 0)
+		return nil
+	})
+	assert.Assert(err == nil)
+}
+
+func TestSavepoint(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	keys := func(tx *Tx) string {
+		var res []string
+		err := tx.Ascend("", func(key, value string) bool {
+			res = append(res, key+"="+value)
+			return true
+		})
+		assert.Assert(err == nil)
+		return strings.Join(res, ",")
+	}
+	idxvals := func(tx *Tx, index string) string {
+		var res []string
+		err := tx.Ascend(index, func(key, value string) bool {
+			res = append(res, key)
+			return true
+		})
+		if err != nil {
+			return err.Error()
+		}
+		return strings.Join(res, ",")
+	}
+	assert.Assert(db.Update(func(tx *Tx) error {
+		if err := tx.CreateIndex("vals", "*", IndexString); err != nil {
+			return err
+		}
+		for i, v := range []string{"c", "b", "a"} {
+			key := fmt.Sprintf("key:%d", i)
+			if _, _, err := tx.Set(key, v, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	}) == nil)
+	err := db.Update(func(tx *Tx) error {
+		_, err := tx.Savepoint()
+		return err
+	})
+	assert.Assert(err == nil)
+	err = db.View(func(tx *Tx) error {
+		_, err := tx.Savepoint()
+		return err
+	})
+	assert.Assert(err == ErrTxNotWritable)
+
+	err = db.Update(func(tx *Tx) error {
+		sp1, err := tx.Savepoint()
+		assert.Assert(err == nil)
+		_, _, err = tx.Set("key:0", "z", nil)
+		assert.Assert(err == nil)
+		_, err = tx.Delete("key:1")
+		assert.Assert(err == nil)
+		_, _, err = tx.Set("key:3", "d", nil)
+		assert.Assert(err == nil)
+		assert.Assert(tx.DropIndex("vals") == nil)
+		assert.Assert(tx.CreateIndex("keys", "*", IndexBinary) == nil)
+		assert.Assert(keys(tx) == "key:0=z,key:2=a,key:3=d")
+		assert.Assert(tx.RollbackTo(sp1) == nil)
+		assert.Assert(keys(tx) == "key:0=c,key:1=b,key:2=a")
+		assert.Assert(idxvals(tx, "vals") == "key:2,key:1,key:0")
+		assert.Assert(idxvals(tx, "keys") == "not found")
+
+		// nested savepoints and releasing
+		_, _, err = tx.Set("key:4", "e", nil)
+		assert.Assert(err == nil)
+		sp2, err := tx.Savepoint()
+		assert.Assert(err == nil)
+		_, _, err = tx.Set("key:4", "f", nil)
+		assert.Assert(err == nil)
+		sp3, err := tx.Savepoint()
+		assert.Assert(err == nil)
+		_, _, err = tx.Set("key:5", "g", nil)
+		assert.Assert(err == nil)
+		assert.Assert(tx.Release(sp3) == nil)
+		assert.Assert(tx.Release(sp3) == ErrInvalidOperation)
+		assert.Assert(keys(tx) ==
+			"key:0=c,key:1=b,key:2=a,key:4=f,key:5=g")
+		assert.Assert(tx.RollbackTo(sp2) == nil)
+		assert.Assert(keys(tx) == "key:0=c,key:1=b,key:2=a,key:4=e")
+		assert.Assert(tx.RollbackTo(sp1) == nil)
+		assert.Assert(tx.RollbackTo(sp2) == ErrInvalidOperation)
+		assert.Assert(keys(tx) == "key:0=c,key:1=b,key:2=a")
+
+		// delete all
+		_, _, err = tx.Set("key:0", "y", nil)
+		assert.Assert(err == nil)
+		sp2, err = tx.Savepoint()
+		assert.Assert(err == nil)
+		_, _, err = tx.Set("key:1", "x", nil)
+		assert.Assert(err == nil)
+		assert.Assert(tx.DeleteAll() == nil)
+		_, _, err = tx.Set("key:6", "h", nil)
+		assert.Assert(err == nil)
+		assert.Assert(keys(tx) == "key:6=h")
+		assert.Assert(tx.RollbackTo(sp2) == nil)
+		assert.Assert(keys(tx) == "key:0=y,key:1=b,key:2=a")
+		assert.Assert(idxvals(tx, "vals") == "key:2,key:1,key:0")
+		assert.Assert(tx.DeleteAll() == nil)
+		_, _, err = tx.Set("key:7", "i", nil)
+		assert.Assert(err == nil)
+		assert.Assert(tx.Release(sp2) == nil)
+		assert.Assert(keys(tx) == "key:7=i")
+		assert.Assert(tx.RollbackTo(sp1) == nil)
+		assert.Assert(keys(tx) == "key:0=c,key:1=b,key:2=a")
+		_, _, err = tx.Set("key:8", "j", nil)
+		assert.Assert(err == nil)
+		assert.Assert(tx.Release(sp1) == nil)
+		return nil
+	})
+	assert.Assert(err == nil)
+
+	// only the released changes were committed
+	db = testReOpen(t, db)
+	assert.Assert(db.Update(func(tx *Tx) error {
+		assert.Assert(keys(tx) == "key:0=c,key:1=b,key:2=a,key:8=j")
+		sp, err := tx.Savepoint()
+		assert.Assert(err == nil)
+		assert.Assert(tx.DeleteAll() == nil)
+		assert.Assert(tx.RollbackTo(sp) == nil)
+		return tx.Release(sp)
+	}) == nil)
+	db = testReOpen(t, db)
+	assert.Assert(db.View(func(tx *Tx) error {
+		assert.Assert(keys(tx) == "key:0=c,key:1=b,key:2=a,key:8=j")
+		return nil
+	}) == nil)
+
+	// rolling back the transaction reverts the released changes too
+	assert.Assert(db.Update(func(tx *Tx) error {
+		sp, err := tx.Savepoint()
+		assert.Assert(err == nil)
+		_, _, err = tx.Set("key:9", "k", nil)
+		assert.Assert(err == nil)
+		assert.Assert(tx.Release(sp) == nil)
+		return errors.New("rollback")
+	}).Error() == "rollback")
+	assert.Assert(db.View(func(tx *Tx) error {
+		assert.Assert(keys(tx) == "key:0=c,key:1=b,key:2=a,key:8=j")
+		return nil
+	}) == nil)
+}
+
+func TestCursor(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	assert.Assert(db.Update(func(tx *Tx) error {
+		if err := tx.CreateIndex("vals", "*", IndexInt); err != nil {
+			return err
+		}
+		if err := tx.CreateSpatialIndex("pts", "*", IndexRect); err != nil {
+			return err
+		}
+		for i := 0; i < 10; i++ {
+			key := fmt.Sprintf("key:%d", i)
+			if _, _, err := tx.Set(key, strconv.Itoa(100-i), nil); err != nil {
+				return err
+			}
+		}
+		_, _, err := tx.Set("key:5", "95", &SetOptions{Expires: true,
+			TTL: time.Millisecond})
+		return err
+	}) == nil)
+	time.Sleep(time.Millisecond * 10)
+	assert.Assert(db.View(func(tx *Tx) error {
+		_, err := tx.Cursor("missing")
+		assert.Assert(err == ErrNotFound)
+
+		c, err := tx.Cursor("")
+		assert.Assert(err == nil)
+		defer c.Close()
+		assert.Assert(!c.Next() && c.Key() == "")
+		var keys []string
+		for ok := c.First(); ok; ok = c.Next() {
+			keys = append(keys, c.Key())
+		}
+		assert.Assert(strings.Join(keys, ",") ==
+			"key:0,key:1,key:2,key:3,key:4,key:6,key:7,key:8,key:9")
+		assert.Assert(!c.Prev() && c.Key() == "" && c.Value() == "")
+		assert.Assert(c.Seek("key:5") && c.Key() == "key:6")
+		assert.Assert(c.Prev() && c.Key() == "key:4" && c.Value() == "96")
+		assert.Assert(c.Next() && c.Key() == "key:6")
+		assert.Assert(!c.Seek("key:a"))
+		assert.Assert(c.Last() && c.Key() == "key:9")
+
+		c2, err := tx.Cursor("vals")
+		assert.Assert(err == nil)
+		defer c2.Close()
+		assert.Assert(c2.First() && c2.Key() == "key:9" && c2.Value() == "91")
+		assert.Assert(c2.Seek("95") && c2.Key() == "key:4")
+		assert.Assert(c2.Prev() && c2.Key() == "key:6")
+		assert.Assert(c2.Last() && c2.Key() == "key:0")
+
+		c3, err := tx.Cursor("pts")
+		assert.Assert(err == nil)
+		assert.Assert(!c3.First() && !c3.Last())
+		c3.Close()
+		c3.Close()
+		return nil
+	}) == nil)
+
+	// an open cursor is iterating
+	assert.Assert(db.Update(func(tx *Tx) error {
+		c, err := tx.Cursor("")
+		assert.Assert(err == nil)
+		assert.Assert(c.First())
+		_, _, err = tx.Set("key:0", "0", nil)
+		assert.Assert(err == ErrTxIterating)
+		c.Close()
+		assert.Assert(!c.Next())
+		_, _, err = tx.Set("key:0", "0", nil)
+		return err
+	}) == nil)
+
+	// closing the transaction invalidates the cursor
+	tx, err := db.Begin(false)
+	assert.Assert(err == nil)
+	c, err := tx.Cursor("")
+	assert.Assert(err == nil)
+	assert.Assert(tx.Rollback() == nil)
+	assert.Assert(!c.First())
+	c.Close()
+
+	// committing applies the mutations that are deferred by an open cursor
+	assert.Assert(db.SetConfig(Config{SyncPolicy: EverySecond,
+		DeferIteratingMutations: true}) == nil)
+	tx, err = db.Begin(true)
+	assert.Assert(err == nil)
+	c, err = tx.Cursor("")
+	assert.Assert(err == nil)
+	assert.Assert(c.First())
+	_, _, err = tx.Set("b", "2", nil)
+	assert.Assert(err == nil)
+	assert.Assert(tx.Commit() == nil)
+	c.Close()
+	db = testReOpen(t, db)
+	assert.Assert(db.View(func(tx *Tx) error {
+		val, err := tx.Get("b")
+		assert.Assert(err == nil && val == "2")
+		return nil
+	}) == nil)
+}
+
+func TestConditionalWrites(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	assert.Assert(db.Update(func(tx *Tx) error {
+		// only if absent
+		_, _, err := tx.Set("lock", "a", &SetOptions{NX: true,
+			Expires: true, TTL: time.Millisecond * 20})
+		assert.Assert(err == nil)
+		_, _, err = tx.Set("lock", "b", &SetOptions{NX: true})
+		assert.Assert(err == ErrConditionFailed)
+		// only if present
+		_, _, err = tx.Set("missing", "a", &SetOptions{XX: true})
+		assert.Assert(err == ErrConditionFailed)
+		_, err = tx.Get("missing")
+		assert.Assert(err == ErrNotFound)
+		prev, replaced, err := tx.Set("lock", "c", &SetOptions{XX: true,
+			Expires: true, TTL: time.Millisecond * 20})
+		assert.Assert(err == nil && replaced && prev == "a")
+		// compare and swap
+		assert.Assert(tx.CompareAndSwap("lock", "a", "d", nil) ==
+			ErrConditionFailed)
+		assert.Assert(tx.CompareAndSwap("missing", "", "d", nil) ==
+			ErrConditionFailed)
+		assert.Assert(tx.CompareAndSwap("lock", "c", "d",
+			&SetOptions{NX: true, Expires: true,
+				TTL: time.Millisecond * 20}) == nil)
+		val, err := tx.Get("lock")
+		assert.Assert(err == nil && val == "d")
+		ttl, err := tx.TTL("lock")
+		assert.Assert(err == nil && ttl > 0)
+		// compare and delete
+		assert.Assert(tx.CompareAndDelete("lock", "c") == ErrConditionFailed)
+		assert.Assert(tx.CompareAndDelete("lock", "d") == nil)
+		assert.Assert(tx.CompareAndDelete("lock", "d") == ErrConditionFailed)
+		_, _, err = tx.Set("lock", "e", &SetOptions{NX: true,
+			Expires: true, TTL: time.Millisecond * 20})
+		return err
+	}) == nil)
+	// expired keys are absent
+	time.Sleep(time.Millisecond * 50)
+	assert.Assert(db.Update(func(tx *Tx) error {
+		_, _, err := tx.Set("lock", "f", &SetOptions{XX: true})
+		assert.Assert(err == ErrConditionFailed)
+		_, _, err = tx.Set("lock", "f", &SetOptions{NX: true})
+		return err
+	}) == nil)
+	assert.Assert(db.View(func(tx *Tx) error {
+		assert.Assert(tx.CompareAndSwap("lock", "f", "g", nil) ==
+			ErrTxNotWritable)
+		return nil
+	}) == nil)
+}
+
+func TestMutationOperations(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	assert.Assert(db.CreateIndex("vals", "*", IndexInt) == nil)
+	assert.Assert(db.Update(func(tx *Tx) error {
+		n, err := tx.IncrBy("counter", 5, nil)
+		assert.Assert(err == nil && n == 5)
+		n, err = tx.IncrBy("counter", -7, &SetOptions{Expires: true,
+			TTL: time.Hour})
+		assert.Assert(err == nil && n == -2)
+		// keep the ttl
+		n, err = tx.IncrBy("counter", 3, &SetOptions{KeepTTL: true})
+		assert.Assert(err == nil && n == 1)
+		ttl, err := tx.TTL("counter")
+		assert.Assert(err == nil && ttl > time.Minute)
+		// the ttl is only used for new keys
+		n, err = tx.IncrBy("counter", 1, &SetOptions{KeepTTL: true,
+			Expires: true, TTL: time.Second})
+		assert.Assert(err == nil && n == 2)
+		ttl, err = tx.TTL("counter")
+		assert.Assert(err == nil && ttl > time.Minute)
+		n, err = tx.IncrBy("new", 1, &SetOptions{KeepTTL: true,
+			Expires: true, TTL: time.Minute})
+		assert.Assert(err == nil && n == 1)
+		ttl, err = tx.TTL("new")
+		assert.Assert(err == nil && ttl > time.Second && ttl <= time.Minute)
+		// a nil opts removes the ttl
+		_, err = tx.IncrBy("counter", 1, nil)
+		assert.Assert(err == nil)
+		ttl, err = tx.TTL("counter")
+		assert.Assert(err == nil && ttl < 0)
+		_, _, err = tx.Set("max", strconv.FormatInt(math.MaxInt64, 10), nil)
+		assert.Assert(err == nil)
+		_, err = tx.IncrBy("max", 1, nil)
+		assert.Assert(err == ErrInvalidOperation)
+		_, _, err = tx.Set("text", "hello", nil)
+		assert.Assert(err == nil)
+		_, err = tx.IncrBy("text", 1, nil)
+		assert.Assert(err == ErrNotNumber)
+
+		f, err := tx.IncrByFloat("float", 1.5, nil)
+		assert.Assert(err == nil && f == 1.5)
+		f, err = tx.IncrByFloat("float", 0.25, nil)
+		assert.Assert(err == nil && f == 1.75)
+		_, err = tx.IncrByFloat("text", 1, nil)
+		assert.Assert(err == ErrNotNumber)
+		_, err = tx.IncrByFloat("float", math.Inf(1), nil)
+		assert.Assert(err == ErrInvalidOperation)
+
+		size, err := tx.Append("text", " world", nil)
+		assert.Assert(err == nil && size == 11)
+		size, err = tx.Append("append", "abc", nil)
+		assert.Assert(err == nil && size == 3)
+
+		size, err = tx.SetRange("text", 6, "there", nil)
+		assert.Assert(err == nil && size == 11)
+		size, err = tx.SetRange("text", 13, "!", nil)
+		assert.Assert(err == nil && size == 14)
+		_, err = tx.SetRange("text", -1, "!", nil)
+		assert.Assert(err == ErrInvalidOperation)
+		_, err = tx.SetRange("text", 512*1024*1024, "!", nil)
+		assert.Assert(err == ErrInvalidOperation)
+		_, err = tx.SetRange("text", math.MaxInt, "!", nil)
+		assert.Assert(err == ErrInvalidOperation)
+		size, err = tx.SetRange("text", 512*1024*1024-1, "", nil)
+		assert.Assert(err == nil && size == 14)
+		size, err = tx.SetRange("nothing", 0, "", nil)
+		assert.Assert(err == nil && size == 0)
+		_, err = tx.Get("nothing")
+		assert.Assert(err == ErrNotFound)
+
+		prev, replaced, err := tx.GetSet("append", "xyz", nil)
+		assert.Assert(err == nil && replaced && prev == "abc")
+
+		// the indexes are updated
+		var found bool
+		err = tx.AscendEqual("vals", "3", func(key, value string) bool {
+			found = key == "counter"
+			return !found
+		})
+		assert.Assert(err == nil && found)
+		return nil
+	}) == nil)
+	db = testReOpen(t, db)
+	assert.Assert(db.View(func(tx *Tx) error {
+		for key, exp := range map[string]string{
+			"counter": "3",
+			"float":   "1.75",
+			"text":    "hello there\x00\x00!",
+			"append":  "xyz",
+		} {
+			val, err := tx.Get(key)
+			assert.Assert(err == nil && val == exp)
+		}
+		_, err := tx.IncrBy("counter", 1, nil)
+		assert.Assert(err == ErrTxNotWritable)
+		return nil
+	}) == nil)
+}
+
+func TestCommitItemsRecording(t *testing.T) {
+	db, err := Open(":memory:")
+	assert.Assert(err == nil)
+	defer db.Close()
+	// nothing needs the changed items of an in-memory database
+	assert.Assert(db.Update(func(tx *Tx) error {
+		tx.Set("key:1", "val", nil)
+		tx.Delete("key:1")
+		assert.Assert(tx.wc.commitItems == nil && tx.wc.changed)
+		return nil
+	}) == nil)
+	var changes []Change
+	assert.Assert(db.SetConfig(Config{OnCommit: func(list []Change) {
+		changes = append(changes, list...)
+	}}) == nil)
+	assert.Assert(db.Update(func(tx *Tx) error {
+		tx.Set("key:2", "val", nil)
+		assert.Assert(len(tx.wc.commitItems) == 1)
+		return nil
+	}) == nil)
+	assert.Assert(len(changes) == 1 && changes[0].Key == "key:2")
+}
+
+func TestOnCommit(t *testing.T) {
+	db, err := Open(":memory:")
+	assert.Assert(err == nil)
+	defer db.Close()
+	var mu sync.Mutex
+	var changes [][]Change
+	var config Config
+	assert.Assert(db.ReadConfig(&config) == nil)
+	config.OnCommit = func(c []Change) {
+		mu.Lock()
+		changes = append(changes, c)
+		mu.Unlock()
+	}
+	assert.Assert(db.SetConfig(config) == nil)
+	assert.Assert(db.Update(func(tx *Tx) error {
+		for _, key := range []string{"b", "a", "c"} {
+			if _, _, err := tx.Set(key, key+"1", nil); err != nil {
+				return err
+			}
+		}
+		_, _, err := tx.Set("d", "d1", &SetOptions{Expires: true,
+			TTL: time.Hour})
+		return err
+	}) == nil)
+	assert.Assert(len(changes) == 1 && len(changes[0]) == 4)
+	for i, key := range []string{"a", "b", "c", "d"} {
+		c := changes[0][i]
+		assert.Assert(c.Key == key && c.NewValue == key+"1" && !c.Existed &&
+			!c.Deleted)
+	}
+	assert.Assert(changes[0][0].TTL == 0 && changes[0][3].TTL > time.Minute)
+
+	// replacing, deleting, and a delete of a missing key
+	changes = nil
+	assert.Assert(db.Update(func(tx *Tx) error {
+		tx.Set("a", "a2", nil)
+		tx.Delete("b")
+		tx.Delete("missing")
+		return nil
+	}) == nil)
+	assert.Assert(len(changes) == 1 && len(changes[0]) == 2)
+	assert.Assert(changes[0][0] == Change{Key: "a", OldValue: "a1",
+		Existed: true, NewValue: "a2"})
+	assert.Assert(changes[0][1] == Change{Key: "b", OldValue: "b1",
+		Existed: true, Deleted: true})
+
+	// rollbacks and read-only transactions are not reported
+	changes = nil
+	assert.Assert(db.Update(func(tx *Tx) error {
+		tx.Set("a", "a3", nil)
+		return errors.New("rollback")
+	}) != nil)
+	assert.Assert(db.View(func(tx *Tx) error { return nil }) == nil)
+	assert.Assert(len(changes) == 0)
+
+	// deleteAll reports every deleted key with its original value
+	assert.Assert(db.Update(func(tx *Tx) error {
+		tx.Set("a", "a3", nil)
+		tx.Delete("c")
+		if err := tx.DeleteAll(); err != nil {
+			return err
+		}
+		_, _, err := tx.Set("e", "e1", nil)
+		return err
+	}) == nil)
+	assert.Assert(len(changes) == 1 && len(changes[0]) == 4)
+	for i, key := range []string{"a", "c", "d", "e"} {
+		assert.Assert(changes[0][i].Key == key)
+	}
+	assert.Assert(changes[0][0] == Change{Key: "a", OldValue: "a2",
+		Existed: true, Deleted: true})
+	assert.Assert(changes[0][1] == Change{Key: "c", OldValue: "c1",
+		Existed: true, Deleted: true})
+	assert.Assert(changes[0][3] == Change{Key: "e", NewValue: "e1"})
+
+	// expired items removed in the background are reported
+	changes = nil
+	assert.Assert(db.Update(func(tx *Tx) error {
+		_, _, err := tx.Set("f", "f1", &SetOptions{Expires: true,
+			TTL: time.Millisecond})
+		return err
+	}) == nil)
+	var n int
+	for i := 0; i < 30 && n < 2; i++ {
+		time.Sleep(time.Second / 10)
+		mu.Lock()
+		n = len(changes)
+		mu.Unlock()
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Assert(len(changes) == 2)
+	assert.Assert(changes[1][0] == Change{Key: "f", OldValue: "f1",
+		Existed: true, Deleted: true, Expired: true})
+}
+
+func TestSubscribe(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	_, err := db.Subscribe(0, "*")
+	assert.Assert(err == ErrInvalidOperation)
+	enable := func(db *DB) {
+		var config Config
+		assert.Assert(db.ReadConfig(&config) == nil)
+		config.ChangeRetention = 2
+		assert.Assert(db.SetConfig(config) == nil)
+	}
+	set := func(db *DB, key, value string) {
+		assert.Assert(db.Update(func(tx *Tx) error {
+			_, _, err := tx.Set(key, value, nil)
+			return err
+		}) == nil)
+	}
+	recv := func(sub *Subscription) ChangeBatch {
+		select {
+		case batch := <-sub.C:
+			return batch
+		case <-time.After(time.Second * 5):
+			t.Fatal("timeout")
+		}
+		return ChangeBatch{}
+	}
+	enable(db)
+	all, err := db.Subscribe(0, "*")
+	assert.Assert(err == nil)
+	users, err := db.Subscribe(0, "user:*")
+	assert.Assert(err == nil)
+	set(db, "user:1", "tom")
+	batch := recv(all)
+	assert.Assert(batch.Seq == 1 && !batch.Snapshot &&
+		len(batch.Changes) == 1 && batch.Changes[0].Key == "user:1")
+	batch = recv(users)
+	assert.Assert(batch.Seq == 1 && batch.Changes[0].NewValue == "tom")
+	set(db, "other", "1")
+	batch = recv(all)
+	assert.Assert(batch.Seq == 2 && batch.Changes[0] == Change{Key: "other",
+		NewValue: "1"})
+	assert.Assert(db.Update(func(tx *Tx) error {
+		tx.Set("user:2", "ann", nil)
+		tx.Set("other", "2", nil)
+		return nil
+	}) == nil)
+	batch = recv(all)
+	assert.Assert(batch.Seq == 3 && len(batch.Changes) == 2)
+	batch = recv(users)
+	assert.Assert(batch.Seq == 3 && len(batch.Changes) == 1 &&
+		batch.Changes[0] == Change{Key: "user:2", NewValue: "ann"})
+	all.Close()
+	users.Close()
+	_, ok := <-all.C
+	assert.Assert(!ok)
+
+	// resuming within the retained batches
+	sub, err := db.Subscribe(1, "*")
+	assert.Assert(err == nil)
+	assert.Assert(recv(sub).Seq == 2 && recv(sub).Seq == 3)
+	sub.Close()
+
+	// falling behind the retained batches starts with a snapshot
+	sub, err = db.Subscribe(0, "user:*")
+	assert.Assert(err == nil)
+	batch = recv(sub)
+	assert.Assert(batch.Seq == 3 && batch.Snapshot && len(batch.Changes) == 2)
+	assert.Assert(batch.Changes[0] == Change{Key: "user:1", NewValue: "tom"})
+	assert.Assert(batch.Changes[1] == Change{Key: "user:2", NewValue: "ann"})
+	set(db, "user:3", "sam")
+	batch = recv(sub)
+	assert.Assert(batch.Seq == 4 && !batch.Snapshot &&
+		batch.Changes[0].Key == "user:3")
+
+	// closing the database closes the subscriptions
+	db = testReOpen(t, db)
+	_, ok = <-sub.C
+	assert.Assert(!ok)
+
+	// the sequence is persisted, including after a shrink
+	enable(db)
+	assert.Assert(db.Shrink() == nil)
+	set(db, "user:4", "liz")
+	db = testReOpen(t, db)
+	enable(db)
+	sub, err = db.Subscribe(5, "*")
+	assert.Assert(err == nil)
+	set(db, "user:5", "bob")
+	batch = recv(sub)
+	assert.Assert(batch.Seq == 6 && batch.Changes[0].Key == "user:5")
+	sub.Close()
+}
+
+func TestNotify(t *testing.T) {
+	db, err := Open(":memory:")
+	assert.Assert(err == nil)
+	defer db.Close()
+	all, err := db.Notify("*", nil)
+	assert.Assert(err == nil)
+	users, err := db.Notify("user:*", &NotifyOptions{Events: EventDel})
+	assert.Assert(err == nil)
+	assert.Assert(db.Update(func(tx *Tx) error {
+		tx.Set("user:1", "tom", &SetOptions{Expires: true,
+			TTL: time.Millisecond * 100})
+		tx.Set("user:2", "ann", nil)
+		tx.Set("other", "1", nil)
+		return nil
+	}) == nil)
+	// rolled back changes are not raised
+	assert.Assert(db.Update(func(tx *Tx) error {
+		tx.Delete("other")
+		return errors.New("rollback")
+	}) != nil)
+	assert.Assert(db.Update(func(tx *Tx) error {
+		_, err := tx.Delete("user:2")
+		return err
+	}) == nil)
+	recv := func(n *Notifier) KeyEvent {
+		select {
+		case ev := <-n.C:
+			return ev
+		case <-time.After(time.Second * 5):
+			t.Fatal("timeout")
+		}
+		return KeyEvent{}
+	}
+	for _, ev := range []KeyEvent{
+		{EventSet, "other"},
+		{EventSet, "user:1"},
+		{EventExpire, "user:1"},
+		{EventSet, "user:2"},
+		{EventDel, "user:2"},
+		{EventExpired, "user:1"},
+	} {
+		assert.Assert(recv(all) == ev)
+	}
+	assert.Assert(recv(users) == KeyEvent{EventDel, "user:2"})
+	assert.Assert(EventExpired.String() == "expired")
+	users.Close()
+	_, ok := <-users.C
+	assert.Assert(!ok)
+
+	// overflow policies
+	newest, err := db.Notify("*", &NotifyOptions{Buffer: 2})
+	assert.Assert(err == nil)
+	oldest, err := db.Notify("*", &NotifyOptions{Buffer: 2,
+		Overflow: DropOldest})
+	assert.Assert(err == nil)
+	closing, err := db.Notify("*", &NotifyOptions{Buffer: 2,
+		Overflow: CloseOnOverflow})
+	assert.Assert(err == nil)
+	assert.Assert(db.Update(func(tx *Tx) error {
+		for _, key := range []string{"a", "b", "c"} {
+			tx.Set(key, key, nil)
+		}
+		return nil
+	}) == nil)
+	assert.Assert(recv(newest).Key == "a" && recv(newest).Key == "b")
+	assert.Assert(newest.Dropped() == 1)
+	assert.Assert(recv(oldest).Key == "b" && recv(oldest).Key == "c")
+	assert.Assert(oldest.Dropped() == 1)
+	assert.Assert(recv(closing).Key == "a" && recv(closing).Key == "b")
+	_, ok = <-closing.C
+	assert.Assert(!ok)
+
+	// closing the database closes the notifiers
+	assert.Assert(db.Close() == nil)
+	var n int
+	for range all.C {
+		n++
+	}
+	assert.Assert(n == 3)
+	newest.Close()
+}
+
+func TestWatch(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	set := func(key, value string, opts *SetOptions) {
+		assert.Assert(db.Update(func(tx *Tx) error {
+			_, _, err := tx.Set(key, value, opts)
+			return err
+		}) == nil)
+	}
+	watch := func(keys ...string) *WatchToken {
+		var token *WatchToken
+		assert.Assert(db.View(func(tx *Tx) error {
+			var err error
+			token, err = tx.Watch(keys...)
+			return err
+		}) == nil)
+		return token
+	}
+	assertToken := func(token *WatchToken) error {
+		return db.Update(func(tx *Tx) error {
+			if err := tx.Assert(token); err != nil {
+				return err
+			}
+			_, _, err := tx.Set("result", "ok", nil)
+			return err
+		})
+	}
+	set("a", "1", nil)
+	set("b", "1", nil)
+
+	// unrelated changes do not fail the assertion
+	token := watch("a", "missing")
+	set("b", "2", nil)
+	assert.Assert(assertToken(token) == nil)
+
+	// setting a key, even to the same value, is a change
+	token = watch("a", "missing")
+	set("a", "1", nil)
+	assert.Assert(assertToken(token) == ErrWatchedKeyChanged)
+	token = watch("a", "missing")
+	set("missing", "1", nil)
+	assert.Assert(assertToken(token) == ErrWatchedKeyChanged)
+
+	// rolled back changes are not changes
+	token = watch("a")
+	assert.Assert(db.Update(func(tx *Tx) error {
+		tx.Delete("a")
+		return errors.New("rollback")
+	}) != nil)
+	assert.Assert(assertToken(token) == nil)
+
+	// the changes of the asserting transaction are not taken into account
+	token = watch("a")
+	assert.Assert(db.Update(func(tx *Tx) error {
+		tx.Set("a", "2", nil)
+		return tx.Assert(token)
+	}) == nil)
+
+	// expired keys are missing
+	set("c", "1", &SetOptions{Expires: true, TTL: time.Second / 10})
+	token = watch("c")
+	time.Sleep(time.Second / 5)
+	token2 := watch("c")
+	assert.Assert(assertToken(token) == ErrWatchedKeyChanged)
+	assert.Assert(assertToken(token2) == nil)
+	// removing a key that was already expired is not a change
+	token2 = watch("c")
+	assert.Assert(db.SweepExpired() == nil)
+	assert.Assert(assertToken(token2) == nil)
+
+	// a missing key that was set and deleted in between has changed
+	del := func(key string) {
+		assert.Assert(db.Update(func(tx *Tx) error {
+			_, err := tx.Delete(key)
+			return err
+		}) == nil)
+	}
+	token = watch("gone")
+	set("gone", "1", nil)
+	del("gone")
+	assert.Assert(assertToken(token) == ErrWatchedKeyChanged)
+	token = watch("gone")
+	b := db.Batch()
+	b.Set("gone", "1", nil)
+	assert.Assert(b.Commit() == nil)
+	b = db.Batch()
+	b.Delete("gone")
+	assert.Assert(b.Commit() == nil)
+	assert.Assert(assertToken(token) == ErrWatchedKeyChanged)
+	// but not when it was set and deleted by the same transaction
+	token = watch("gone")
+	assert.Assert(db.Update(func(tx *Tx) error {
+		tx.Set("gone", "1", nil)
+		_, err := tx.Delete("gone")
+		return err
+	}) == nil)
+	assert.Assert(assertToken(token) == nil)
+	// optimistic transactions check the missing keys at commit
+	token = watch("gone")
+	tx, err := db.BeginOptimistic()
+	assert.Assert(err == nil)
+	set("gone", "1", nil)
+	del("gone")
+	assert.Assert(tx.Assert(token) == nil)
+	assert.Assert(tx.Commit() == ErrConflict)
+
+	// optimistic transactions check the keys again at commit
+	token = watch("a")
+	tx, err = db.BeginOptimistic()
+	assert.Assert(err == nil)
+	assert.Assert(tx.Assert(token) == nil)
+	set("a", "3", nil)
+	_, _, err = tx.Set("result", "ok", nil)
+	assert.Assert(err == nil)
+	assert.Assert(tx.Commit() == ErrConflict)
+
+	assert.Assert(db.View(func(tx *Tx) error {
+		_, err := tx.Watch("a")
+		assert.Assert(err == nil)
+		return tx.Assert(nil)
+	}) == ErrInvalidOperation)
+}
+
+func TestBatch(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	assert.Assert(db.CreateIndex("vals", "*", IndexString) == nil)
+	assert.Assert(db.CreateSpatialIndex("pts", "pt:*", IndexRect) == nil)
+	var changes []Change
+	var config Config
+	assert.Assert(db.ReadConfig(&config) == nil)
+	config.OnCommit = func(c []Change) {
+		changes = c
+	}
+	assert.Assert(db.SetConfig(config) == nil)
+	assert.Assert(db.Update(func(tx *Tx) error {
+		_, _, err := tx.Set("key:1", "old", nil)
+		return err
+	}) == nil)
+	b := db.Batch()
+	for i := 99; i >= 0; i-- {
+		key := fmt.Sprintf("key:%d", i)
+		assert.Assert(b.Set(key, fmt.Sprintf("val:%03d", i), nil) == nil)
+	}
+	assert.Assert(b.Set("key:2", "last", &SetOptions{Expires: true,
+		TTL: time.Hour}) == nil)
+	b.Delete("key:3")
+	b.Delete("missing")
+	assert.Assert(b.Set("pt:1", "[1 1]", nil) == nil)
+	assert.Assert(b.Set("key:4", "nx", &SetOptions{NX: true}) ==
+		ErrInvalidOperation)
+	assert.Assert(b.Len() == 104)
+	assert.Assert(b.Commit() == nil)
+	assert.Assert(b.Len() == 0)
+
+	// the last operation of a key wins, and deleting a missing key is
+	// not a change.
+	assert.Assert(len(changes) == 100)
+	assert.Assert(changes[1] == Change{Key: "key:1", OldValue: "old",
+		Existed: true, NewValue: "val:001"})
+	assert.Assert(changes[12].Key == "key:2" &&
+		changes[12].NewValue == "last" && changes[12].TTL > time.Minute)
+	assert.Assert(changes[23].Key == "key:30")
+
+	check := func(db *DB, indexes bool) {
+		assert.Assert(db.View(func(tx *Tx) error {
+			n, err := tx.Len()
+			assert.Assert(err == nil && n == 100)
+			val, err := tx.Get("key:1")
+			assert.Assert(err == nil && val == "val:001")
+			_, err = tx.Get("key:3")
+			assert.Assert(err == ErrNotFound)
+			ttl, err := tx.TTL("key:2")
+			assert.Assert(err == nil && ttl > time.Minute)
+			if !indexes {
+				return nil
+			}
+			var keys []string
+			tx.Ascend("vals", func(key, val string) bool {
+				keys = append(keys, key)
+				return true
+			})
+			assert.Assert(len(keys) == 100 && keys[0] == "pt:1" &&
+				keys[1] == "key:2" && keys[2] == "key:0" &&
+				keys[99] == "key:99")
+			var pts int
+			tx.Intersects("pts", "[0 0],[2 2]", func(key, val string) bool {
+				pts++
+				return true
+			})
+			assert.Assert(pts == 1)
+			return nil
+		}) == nil)
+	}
+	check(db, true)
+	db = testReOpen(t, db)
+	check(db, false)
+	assert.Assert(db.Batch().Commit() == nil)
+	assert.Assert(db.Close() == nil)
+	b = db.Batch()
+	b.Delete("key:1")
+	assert.Assert(b.Commit() == ErrDatabaseClosed)
+}
+
+func TestCloseContext(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	assert.Assert(db.Update(func(tx *Tx) error {
+		for i := 0; i < 10; i++ {
+			tx.Set(fmt.Sprintf("key:%d", i), "val", nil)
+		}
+		return nil
+	}) == nil)
+	// closing without open transactions stops the background manager
+	open, err := db.CloseContext(context.Background())
+	assert.Assert(err == nil && open == 0)
+	<-db.bgdone
+	open, err = db.CloseContext(context.Background())
+	assert.Assert(err == ErrDatabaseClosed && open == 0)
+
+	// open transactions are waited for until the deadline
+	db = testReOpen(t, nil)
+	rtx, err := db.Begin(false)
+	assert.Assert(err == nil)
+	wtx, err := db.BeginOptimistic()
+	assert.Assert(err == nil)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second/10)
+	defer cancel()
+	open, err = db.CloseContext(ctx)
+	assert.Assert(err == context.DeadlineExceeded && open == 1)
+	_, err = db.Begin(false)
+	assert.Assert(err == ErrDatabaseClosed)
+	_, err = db.BeginSnapshot()
+	assert.Assert(err == ErrDatabaseClosed)
+	ctx2, cancel2 := context.WithTimeout(context.Background(), time.Second/10)
+	defer cancel2()
+	open, err = db.CloseContext(ctx2)
+	assert.Assert(err == context.DeadlineExceeded && open == 1)
+	// the iterations of the open transactions are aborted
+	var n int
+	err = rtx.Ascend("", func(key, value string) bool {
+		n++
+		return true
+	})
+	assert.Assert(err == ErrDatabaseClosed && n == 0)
+	val, err := rtx.Get("key:1")
+	assert.Assert(err == nil && val == "val")
+	// optimistic transactions cannot commit once closing
+	_, _, err = wtx.Set("key:1", "new", nil)
+	assert.Assert(err == nil)
+	assert.Assert(wtx.Commit() == ErrDatabaseClosed)
+	// the database is closed once the last transaction has finished, and a
+	// later Close finishes the shutdown
+	go func() {
+		time.Sleep(time.Second / 10)
+		rtx.Rollback()
+	}()
+	assert.Assert(db.Close() == nil)
+	db.mu.RLock()
+	assert.Assert(db.closed)
+	db.mu.RUnlock()
+	assert.Assert(db.Close() == ErrDatabaseClosed)
+	db = testReOpen(t, nil)
+	assert.Assert(db.View(func(tx *Tx) error {
+		val, err := tx.Get("key:1")
+		assert.Assert(err == nil && val == "val")
+		return nil
+	}) == nil)
+}
+
+func TestMillisecondTTL(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	assert.Assert(db.Update(func(tx *Tx) error {
+		_, _, err := tx.Set("key", "val", &SetOptions{Expires: true,
+			TTL: time.Millisecond * 1500})
+		return err
+	}) == nil)
+	db = testReOpen(t, db)
+	assert.Assert(db.View(func(tx *Tx) error {
+		ttl, err := tx.TTL("key")
+		assert.Assert(err == nil)
+		assert.Assert(ttl > time.Millisecond*1000 &&
+			ttl <= time.Millisecond*1500)
+		return nil
+	}) == nil)
+	data, err := ioutil.ReadFile("data.db")
+	assert.Assert(err == nil && strings.Contains(string(data), "pxat"))
+
+	// the expiration of older files is in seconds
+	exat := time.Now().Add(time.Hour).Unix()
+	ae := strconv.FormatInt(exat, 10)
+	resp := "*5\r\n$3\r\nset\r\n$3\r\nkey\r\n$3\r\nval\r\n" +
+		"$2\r\nae\r\n$" + strconv.Itoa(len(ae)) + "\r\n" + ae + "\r\n"
+	assert.Assert(db.Close() == nil)
+	assert.Assert(ioutil.WriteFile("data.db", []byte(resp), 0666) == nil)
+	db = testReOpen(t, nil)
+	assert.Assert(db.View(func(tx *Tx) error {
+		ttl, err := tx.TTL("key")
+		assert.Assert(err == nil)
+		assert.Assert(time.Now().Add(ttl).Round(time.Second).Unix() == exat)
+		return nil
+	}) == nil)
+}
+
+func TestExpire(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	big := strings.Repeat("x", 1000)
+	assert.Assert(db.Update(func(tx *Tx) error {
+		_, _, err := tx.Set("key", big, nil)
+		return err
+	}) == nil)
+	ttlOf := func(db *DB, key string) (ttl time.Duration, err error) {
+		db.View(func(tx *Tx) error {
+			ttl, err = tx.TTL(key)
+			return nil
+		})
+		return ttl, err
+	}
+	assert.Assert(db.Update(func(tx *Tx) error {
+		return tx.Expire("key", time.Hour)
+	}) == nil)
+	ttl, err := ttlOf(db, "key")
+	assert.Assert(err == nil && ttl > time.Minute*59)
+
+	// rolling back restores the previous expiration
+	assert.Assert(db.Update(func(tx *Tx) error {
+		assert.Assert(tx.Persist("key") == nil)
+		return errors.New("rollback")
+	}) != nil)
+	ttl, err = ttlOf(db, "key")
+	assert.Assert(err == nil && ttl > time.Minute*59)
+
+	// only the expiration is written to disk
+	data, err := ioutil.ReadFile("data.db")
+	assert.Assert(err == nil && strings.Count(string(data), big) == 1)
+	assert.Assert(strings.Contains(string(data), "pexpireat"))
+
+	exat := time.Now().Add(time.Hour * 2).Truncate(time.Millisecond)
+	assert.Assert(db.Update(func(tx *Tx) error {
+		return tx.ExpireAt("key", exat)
+	}) == nil)
+	db = testReOpen(t, db)
+	ttl, err = ttlOf(db, "key")
+	assert.Assert(err == nil && ttl > time.Hour+time.Minute*59)
+	assert.Assert(db.View(func(tx *Tx) error {
+		val, err := tx.Get("key")
+		assert.Assert(err == nil && val == big)
+		return nil
+	}) == nil)
+
+	assert.Assert(db.Update(func(tx *Tx) error {
+		if err := tx.Persist("key"); err != nil {
+			return err
+		}
+		// persisting a key without an expiration does nothing
+		return tx.Persist("key")
+	}) == nil)
+	db = testReOpen(t, db)
+	ttl, err = ttlOf(db, "key")
+	assert.Assert(err == nil && ttl < 0)
+	data, err = ioutil.ReadFile("data.db")
+	assert.Assert(err == nil && strings.Count(string(data), big) == 1)
+
+	// a changed value is written along with the expiration
+	assert.Assert(db.Update(func(tx *Tx) error {
+		tx.Set("key", big, nil)
+		return tx.Expire("key", time.Hour)
+	}) == nil)
+	data, err = ioutil.ReadFile("data.db")
+	assert.Assert(err == nil && strings.Count(string(data), big) == 2)
+
+	// an expiration in the past removes the key
+	assert.Assert(db.Update(func(tx *Tx) error {
+		return tx.ExpireAt("key", time.Now().Add(-time.Second))
+	}) == nil)
+	_, err = ttlOf(db, "key")
+	assert.Assert(err == ErrNotFound)
+	db = testReOpen(t, db)
+	_, err = ttlOf(db, "key")
+	assert.Assert(err == ErrNotFound)
+
+	assert.Assert(db.Update(func(tx *Tx) error {
+		assert.Assert(tx.Expire("missing", time.Hour) == ErrNotFound)
+		assert.Assert(tx.Persist("missing") == ErrNotFound)
+		return nil
+	}) == nil)
+	assert.Assert(db.View(func(tx *Tx) error {
+		return tx.Expire("key", time.Hour)
+	}) == ErrTxNotWritable)
+}
+
+func TestSetExpiresAt(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	exat := time.Now().Add(time.Hour).Add(time.Microsecond * 1500)
+	expiresAt := func(db *DB, key string) (t time.Time) {
+		assert.Assert(db.View(func(tx *Tx) error {
+			item := tx.db.get(key)
+			assert.Assert(item != nil && item.opts != nil && item.opts.ex)
+			t = item.opts.exat
+			return nil
+		}) == nil)
+		return t
+	}
+	assert.Assert(db.Update(func(tx *Tx) error {
+		// ExpiresAt is used instead of the TTL
+		_, _, err := tx.Set("key", "val", &SetOptions{ExpiresAt: exat,
+			Expires: true, TTL: time.Second})
+		if err != nil {
+			return err
+		}
+		_, _, err = tx.Set("past", "val", &SetOptions{
+			ExpiresAt: time.Now().Add(-time.Second),
+		})
+		return err
+	}) == nil)
+	assert.Assert(expiresAt(db, "key").Equal(exat.Truncate(time.Millisecond)))
+	assert.Assert(db.View(func(tx *Tx) error {
+		_, err := tx.Get("past")
+		return err
+	}) == ErrNotFound)
+	b := db.Batch()
+	assert.Assert(b.Set("batch", "val", &SetOptions{ExpiresAt: exat}) == nil)
+	assert.Assert(b.Commit() == nil)
+	// the expiration round-trips exactly
+	db = testReOpen(t, db)
+	assert.Assert(expiresAt(db, "key").Equal(exat.Truncate(time.Millisecond)))
+	assert.Assert(expiresAt(db, "batch").Equal(exat.Truncate(time.Millisecond)))
+	db = testReOpen(t, db)
+	assert.Assert(db.Shrink() == nil)
+	db = testReOpen(t, db)
+	assert.Assert(expiresAt(db, "key").Equal(exat.Truncate(time.Millisecond)))
+}
+
+func TestSlidingExpiration(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	ttlOf := func(db *DB, key string) (ttl time.Duration) {
+		assert.Assert(db.View(func(tx *Tx) error {
+			var err error
+			ttl, err = tx.TTL(key)
+			return err
+		}) == nil)
+		return ttl
+	}
+	assert.Assert(db.Update(func(tx *Tx) error {
+		tx.Set("session", "data", &SetOptions{Expires: true,
+			TTL: time.Minute, Sliding: true})
+		tx.Set("fixed", "data", &SetOptions{Expires: true, TTL: time.Minute})
+		return nil
+	}) == nil)
+	// move the expirations closer
+	assert.Assert(db.Update(func(tx *Tx) error {
+		tx.Expire("session", time.Second*10)
+		tx.Expire("fixed", time.Second*10)
+		return nil
+	}) == nil)
+	assert.Assert(ttlOf(db, "session") <= time.Second*10)
+
+	// reading in a writable transaction restarts the ttl after it, too
+	assert.Assert(db.Update(func(tx *Tx) error {
+		val, err := tx.Get("session")
+		assert.Assert(err == nil && val == "data")
+		_, err = tx.Get("fixed")
+		assert.Assert(err == nil)
+		ttl, err := tx.TTL("session")
+		assert.Assert(err == nil && ttl <= time.Second*10)
+		return nil
+	}) == nil)
+	assert.Assert(ttlOf(db, "session") > time.Second*50)
+	assert.Assert(ttlOf(db, "fixed") <= time.Second*10)
+
+	// the sliding expiration is persisted
+	db = testReOpen(t, db)
+	assert.Assert(db.Update(func(tx *Tx) error {
+		return tx.Expire("session", time.Second*10)
+	}) == nil)
+	db = testReOpen(t, db)
+
+	// reading in a read-only transaction restarts the ttl, too
+	assert.Assert(db.View(func(tx *Tx) error {
+		_, err := tx.Get("session")
+		return err
+	}) == nil)
+	assert.Assert(ttlOf(db, "session") > time.Second*50)
+
+	// touching a key sets its ttl
+	assert.Assert(db.View(func(tx *Tx) error {
+		val, err := tx.GetAndTouch("fixed", time.Hour)
+		assert.Assert(err == nil && val == "data")
+		_, err = tx.GetAndTouch("missing", time.Hour)
+		assert.Assert(err == ErrNotFound)
+		return nil
+	}) == nil)
+	// a replaced item is not touched
+	assert.Assert(db.View(func(tx *Tx) error {
+		_, err := tx.GetAndTouch("session", time.Hour)
+		return err
+	}) == nil)
+	assert.Assert(db.Update(func(tx *Tx) error {
+		_, _, err := tx.Set("session", "new", &SetOptions{Expires: true,
+			TTL: time.Second * 30})
+		return err
+	}) == nil)
+	time.Sleep(time.Second * 3 / 2)
+	assert.Assert(ttlOf(db, "fixed") > time.Minute*59)
+	assert.Assert(ttlOf(db, "session") <= time.Second*30)
+	db = testReOpen(t, db)
+	assert.Assert(ttlOf(db, "fixed") > time.Minute*59)
+}
+
+func TestSlidingTouchIsNotAChange(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	clock := NewManualClock(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC))
+	var mu sync.Mutex
+	var changes []Change
+	assert.Assert(db.SetConfig(Config{SyncPolicy: Never, Clock: clock,
+		OnCommit: func(list []Change) {
+			mu.Lock()
+			changes = append(changes, list...)
+			mu.Unlock()
+		},
+	}) == nil)
+	assert.Assert(db.Update(func(tx *Tx) error {
+		_, _, err := tx.Set("session", "data", &SetOptions{Expires: true,
+			TTL: time.Second * 10, Sliding: true})
+		return err
+	}) == nil)
+	n, err := db.Notify("*", nil)
+	assert.Assert(err == nil)
+	defer n.Close()
+	ttlOf := func() (ttl time.Duration, err error) {
+		db.View(func(tx *Tx) error {
+			ttl, err = tx.TTL("session")
+			return nil
+		})
+		return ttl, err
+	}
+
+	// optimistic transactions that only read the key do not conflict
+	tx1, err := db.BeginOptimistic()
+	assert.Assert(err == nil)
+	tx2, err := db.BeginOptimistic()
+	assert.Assert(err == nil)
+	_, err = tx1.Get("session")
+	assert.Assert(err == nil)
+	_, err = tx2.Get("session")
+	assert.Assert(err == nil)
+	assert.Assert(tx1.Commit() == nil)
+	assert.Assert(db.SweepExpired() == nil)
+	assert.Assert(tx2.Commit() == nil)
+
+	// a key is refreshed even when it expired before the next transaction
+	clock.Advance(time.Second * 9)
+	assert.Assert(db.Update(func(tx *Tx) error {
+		_, err := tx.Get("session")
+		return err
+	}) == nil)
+	clock.Advance(time.Second * 2)
+	ttl, err := ttlOf()
+	assert.Assert(err == nil && ttl == time.Second*8)
+	assert.Assert(db.SweepExpired() == nil)
+	ttl, err = ttlOf()
+	assert.Assert(err == nil && ttl == time.Second*8)
+
+	// the sweep refreshes a touched key before deciding that it expired
+	clock.Advance(time.Second * 7)
+	assert.Assert(db.View(func(tx *Tx) error {
+		_, err := tx.Get("session")
+		return err
+	}) == nil)
+	clock.Advance(time.Second * 5)
+	assert.Assert(db.SweepExpired() == nil)
+	ttl, err = ttlOf()
+	assert.Assert(err == nil && ttl == time.Second*5)
+
+	// only the expiration is written to disk, and nothing is published
+	data, err := ioutil.ReadFile("data.db")
+	assert.Assert(err == nil)
+	assert.Assert(strings.Count(string(data), "pexpireat") == 3)
+	mu.Lock()
+	assert.Assert(len(changes) == 1)
+	mu.Unlock()
+	assert.Assert(len(n.C) == 0)
+}
+
+func TestBoundedExpiration(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	var config Config
+	assert.Assert(db.ReadConfig(&config) == nil)
+	config.MaxExpirationsPerSweep = 100
+	assert.Assert(db.SetConfig(config) == nil)
+	b := db.Batch()
+	for i := 0; i < 1000; i++ {
+		b.Set(fmt.Sprintf("key:%04d", i), "val", &SetOptions{Expires: true,
+			TTL: time.Second / 10})
+	}
+	b.Set("keep", "val", nil)
+	assert.Assert(b.Commit() == nil)
+	time.Sleep(time.Second / 5)
+	stats, err := db.ExpirationStats()
+	assert.Assert(err == nil)
+	assert.Assert(stats.Backlog+int(stats.Expired) == 1000)
+	// the sweeps are limited, but more frequent while there's a backlog.
+	start := time.Now()
+	for stats.Backlog > 0 {
+		assert.Assert(time.Since(start) < time.Second*5)
+		time.Sleep(time.Second / 10)
+		stats, err = db.ExpirationStats()
+		assert.Assert(err == nil)
+	}
+	assert.Assert(stats.Expired == 1000 && stats.LimitedSweeps >= 9)
+	assert.Assert(stats.Sweeps > stats.LimitedSweeps)
+	assert.Assert(db.View(func(tx *Tx) error {
+		n, err := tx.Len()
+		assert.Assert(err == nil && n == 1)
+		return nil
+	}) == nil)
+}
+
+func TestBoundedOnExpired(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	clock := NewManualClock(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC))
+	var mu sync.Mutex
+	reported := make(map[string]int)
+	assert.Assert(db.SetConfig(Config{
+		SyncPolicy:             Never,
+		Clock:                  clock,
+		MaxExpirationsPerSweep: 2,
+		OnExpired: func(keys []string) {
+			mu.Lock()
+			defer mu.Unlock()
+			assert.Assert(len(keys) <= 2)
+			for _, key := range keys {
+				reported[key]++
+			}
+		},
+	}) == nil)
+	assert.Assert(db.Update(func(tx *Tx) error {
+		for i := 0; i < 5; i++ {
+			_, _, err := tx.Set(fmt.Sprintf("key:%d", i), "val",
+				&SetOptions{Expires: true, TTL: time.Second})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}) == nil)
+	clock.Advance(time.Second * 2)
+	// the keys are left in place, but each key is reported once per round
+	for round := 1; round <= 2; round++ {
+		assert.Assert(db.SweepExpired() == nil)
+		mu.Lock()
+		assert.Assert(len(reported) == 5)
+		for _, n := range reported {
+			assert.Assert(n == round)
+		}
+		mu.Unlock()
+	}
+}
+
+func TestManualClock(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	clock := NewManualClock(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC))
+	assert.Assert(db.SetConfig(Config{SyncPolicy: Never, Clock: clock}) == nil)
+	assert.Assert(db.Update(func(tx *Tx) error {
+		opts := &SetOptions{Expires: true, TTL: time.Minute}
+		if _, _, err := tx.Set("key:1", "val", opts); err != nil {
+			return err
+		}
+		opts = &SetOptions{Expires: true, TTL: time.Hour}
+		_, _, err := tx.Set("key:2", "val", opts)
+		return err
+	}) == nil)
+	ttlOf := func(key string) (ttl time.Duration, err error) {
+		db.View(func(tx *Tx) error {
+			ttl, err = tx.TTL(key)
+			return nil
+		})
+		return ttl, err
+	}
+	ttl, err := ttlOf("key:1")
+	assert.Assert(err == nil && ttl == time.Minute)
+
+	// the items expire as soon as the clock moves past them
+	clock.Advance(time.Minute + time.Second)
+	_, err = ttlOf("key:1")
+	assert.Assert(err == ErrNotFound)
+	ttl, err = ttlOf("key:2")
+	assert.Assert(err == nil && ttl == time.Hour-time.Minute-time.Second)
+	lenOf := func() (n int) {
+		db.View(func(tx *Tx) error {
+			n, _ = tx.Len()
+			return nil
+		})
+		return n
+	}
+	assert.Assert(db.SweepExpired() == nil)
+	assert.Assert(lenOf() == 1)
+
+	// the expirations are persisted relative to the clock
+	b := db.Batch()
+	assert.Assert(b.Set("key:3", "val",
+		&SetOptions{Expires: true, TTL: time.Minute}) == nil)
+	assert.Assert(b.Commit() == nil)
+	data, err := ioutil.ReadFile("data.db")
+	assert.Assert(err == nil)
+	exat := clock.Now().Add(time.Minute).UnixMilli()
+	assert.Assert(strings.Contains(string(data), strconv.FormatInt(exat, 10)))
+
+	clock.Set(clock.Now().Add(time.Hour))
+	assert.Assert(db.SweepExpired() == nil)
+	assert.Assert(lenOf() == 0)
+	stats, err := db.ExpirationStats()
+	assert.Assert(err == nil && stats.Backlog == 0 && stats.Expired == 3)
+}
+
+func TestExpiryEvents(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	start := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewManualClock(start)
+	setExpiring := func(key, val string) {
+		assert.Assert(db.Update(func(tx *Tx) error {
+			_, _, err := tx.Set(key, val,
+				&SetOptions{Expires: true, TTL: time.Second})
+			return err
+		}) == nil)
+	}
+	exists := func(key string) bool {
+		var err error
+		db.View(func(tx *Tx) error {
+			_, err = tx.Get(key, true)
+			return nil
+		})
+		return err == nil
+	}
+
+	// in-transaction callbacks can skip the deletion of an item
+	var mu sync.Mutex
+	var fail bool
+	var events []ExpiryEvent
+	assert.Assert(db.SetConfig(Config{
+		SyncPolicy: Never,
+		Clock:      clock,
+		ExpiryInTx: true,
+		OnExpiry: func(ev ExpiryEvent, tx *Tx) error {
+			mu.Lock()
+			defer mu.Unlock()
+			assert.Assert(tx != nil && ev.InTx)
+			if fail && ev.Key == "key:1" {
+				return errors.New("fail")
+			}
+			events = append(events, ev)
+			return nil
+		},
+	}) == nil)
+	setExpiring("key:0", "val:0")
+	setExpiring("key:1", "val:1")
+	clock.Advance(time.Second * 2)
+	mu.Lock()
+	fail = true
+	mu.Unlock()
+	assert.Assert(db.SweepExpired() == nil)
+	assert.Assert(!exists("key:0") && exists("key:1"))
+	mu.Lock()
+	assert.Assert(len(events) == 1 && events[0].Key == "key:0")
+	events = nil
+	fail = false
+	mu.Unlock()
+	assert.Assert(db.SweepExpired() == nil)
+	assert.Assert(!exists("key:1"))
+	mu.Lock()
+	assert.Assert(len(events) == 1 && events[0].Key == "key:1" &&
+		events[0].Value == "val:1" &&
+		events[0].ExpiresAt.Equal(start.Add(time.Second)))
+	mu.Unlock()
+
+	// items that keep failing don't use up the limit of the sweep
+	assert.Assert(db.SetConfig(Config{
+		SyncPolicy:             Never,
+		Clock:                  clock,
+		ExpiryInTx:             true,
+		MaxExpirationsPerSweep: 1,
+		OnExpiry: func(ev ExpiryEvent, tx *Tx) error {
+			if ev.Key == "key:a" {
+				return errors.New("fail")
+			}
+			return nil
+		},
+	}) == nil)
+	setExpiring("key:a", "val:a")
+	clock.Advance(time.Millisecond)
+	setExpiring("key:b", "val:b")
+	clock.Advance(time.Second * 2)
+	assert.Assert(db.SweepExpired() == nil)
+	assert.Assert(exists("key:a") && !exists("key:b"))
+	assert.Assert(db.Update(func(tx *Tx) error {
+		// expired items are reported as not found, but they are deleted.
+		tx.Delete("key:a")
+		return nil
+	}) == nil)
+	assert.Assert(!exists("key:a"))
+
+	// undelivered events stay in the outbox, even after a restart
+	var ch chan ExpiryEvent
+	config := func(db *DB) {
+		assert.Assert(db.SetConfig(Config{
+			SyncPolicy: Never,
+			Clock:      clock,
+			OnExpiry: func(ev ExpiryEvent, tx *Tx) error {
+				mu.Lock()
+				defer mu.Unlock()
+				assert.Assert(tx == nil && !ev.InTx)
+				if fail {
+					return errors.New("fail")
+				}
+				return nil
+			},
+			ExpiryChannel:          ch,
+			ExpiryOutbox:           "outbox:",
+			MaxExpirationsPerSweep: 1,
+		}) == nil)
+	}
+	ch = make(chan ExpiryEvent, 10)
+	config(db)
+	mu.Lock()
+	fail = true
+	mu.Unlock()
+	setExpiring("key:2", "val:2")
+	setExpiring("key:3", "val:3")
+	clock.Advance(time.Second * 2)
+	assert.Assert(db.SweepExpired() == nil)
+	assert.Assert(!exists("key:2") && !exists("key:3"))
+	okey := outboxKey("outbox:", ExpiryEvent{Key: "key:2",
+		ExpiresAt: clock.Now().Add(-time.Second)})
+	assert.Assert(exists(okey))
+	assert.Assert(len(ch) == 0)
+
+	db = testReOpen(t, db)
+	ch = make(chan ExpiryEvent, 10)
+	config(db)
+	mu.Lock()
+	fail = false
+	mu.Unlock()
+	assert.Assert(db.SweepExpired() == nil)
+	assert.Assert(!exists(okey))
+	ev := <-ch
+	assert.Assert(ev.Key == "key:2" && ev.Value == "val:2" && !ev.InTx &&
+		ev.ExpiresAt.Equal(clock.Now().Add(-time.Second)))
+	ev = <-ch
+	assert.Assert(ev.Key == "key:3" && ev.Value == "val:3")
+	assert.Assert(db.View(func(tx *Tx) error {
+		n, err := tx.Len()
+		assert.Assert(err == nil && n == 0)
+		return nil
+	}) == nil)
+
+	// outbox keys hold times that don't fit in Unix nanoseconds
+	far := time.Date(2300, 1, 2, 3, 4, 5, 6, time.UTC)
+	assert.Assert(db.Update(func(tx *Tx) error {
+		_, _, err := tx.Set(outboxKey("outbox:",
+			ExpiryEvent{Key: "key:4", ExpiresAt: far}), "val:4", nil)
+		assert.Assert(err == nil)
+		events, keys := tx.outboxEvents("outbox:", 0)
+		assert.Assert(len(events) == 1 && len(keys) == 1)
+		assert.Assert(events[0].Key == "key:4" && events[0].Value == "val:4" &&
+			events[0].ExpiresAt.Equal(far))
+		return nil
+	}) == nil)
+}
+
+func TestAscendExpiring(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	start := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewManualClock(start)
+	assert.Assert(db.SetConfig(Config{SyncPolicy: Never, Clock: clock}) == nil)
+	assert.Assert(db.Update(func(tx *Tx) error {
+		for i := 0; i < 10; i++ {
+			opts := &SetOptions{Expires: true,
+				TTL: time.Duration(10-i) * time.Minute}
+			key := fmt.Sprintf("key:%d", i)
+			if _, _, err := tx.Set(key, "val", opts); err != nil {
+				return err
+			}
+		}
+		_, _, err := tx.Set("forever", "val", nil)
+		return err
+	}) == nil)
+	clock.Advance(time.Minute + time.Second)
+	assert.Assert(db.View(func(tx *Tx) error {
+		// the expired key:9 is skipped
+		var keys []string
+		err := tx.AscendExpiring(time.Time{},
+			func(key, value string, exp time.Time) bool {
+				keys = append(keys, key)
+				return true
+			})
+		assert.Assert(err == nil && len(keys) == 9)
+		assert.Assert(keys[0] == "key:8" && keys[8] == "key:0")
+
+		keys = keys[:0]
+		err = tx.AscendExpiring(start.Add(time.Minute*5),
+			func(key, value string, exp time.Time) bool {
+				assert.Assert(exp.Equal(start.Add(time.Minute * 5)))
+				keys = append(keys, key)
+				return false
+			})
+		assert.Assert(err == nil && len(keys) == 1 && keys[0] == "key:5")
+
+		n, err := tx.ExpiringBefore(clock.Now().Add(time.Hour))
+		assert.Assert(err == nil && n == 9)
+		n, err = tx.ExpiringBefore(start.Add(time.Minute * 5))
+		assert.Assert(err == nil && n == 3)
+		n, err = tx.ExpiringBefore(start)
+		assert.Assert(err == nil && n == 0)
+		return nil
+	}) == nil)
+
+	// mutations while iterating are deferred
+	assert.Assert(db.SetConfig(Config{SyncPolicy: Never, Clock: clock,
+		DeferIteratingMutations: true}) == nil)
+	assert.Assert(db.Update(func(tx *Tx) error {
+		err := tx.AscendExpiring(time.Time{},
+			func(key, value string, exp time.Time) bool {
+				_, err := tx.Delete(key)
+				return err == nil
+			})
+		if err != nil {
+			return err
+		}
+		n, err := tx.ExpiringBefore(clock.Now().Add(time.Hour))
+		assert.Assert(err == nil && n == 0)
+		return nil
+	}) == nil)
+}
+
+func TestTTLPolicies(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	clock := NewManualClock(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC))
+	policies := []TTLPolicy{
+		{Pattern: "session:admin:*", TTL: 0},
+		{Pattern: "session:*", TTL: time.Minute * 30},
+		{Pattern: "cache:?", TTL: time.Minute},
+	}
+	assert.Assert(db.SetConfig(Config{SyncPolicy: Never, Clock: clock,
+		TTLPolicies: policies}) == nil)
+	// the policies are copied
+	policies[1].TTL = time.Hour
+	var config Config
+	assert.Assert(db.ReadConfig(&config) == nil)
+	assert.Assert(len(config.TTLPolicies) == 3 &&
+		config.TTLPolicies[1].TTL == time.Minute*30)
+
+	policy, ok, err := db.TTLPolicy("session:1")
+	assert.Assert(err == nil && ok && policy.Pattern == "session:*")
+	policy, ok, err = db.TTLPolicy("session:admin:1")
+	assert.Assert(err == nil && ok && policy.TTL == 0)
+	_, ok, err = db.TTLPolicy("cache:12")
+	assert.Assert(err == nil && !ok)
+
+	assert.Assert(db.Update(func(tx *Tx) error {
+		tx.Set("session:1", "val", nil)
+		tx.Set("session:2", "val", &SetOptions{Expires: true, TTL: time.Hour})
+		tx.Set("session:3", "val", &SetOptions{Persist: true})
+		tx.Set("session:admin:1", "val", nil)
+		tx.Set("cache:1", "val", nil)
+		tx.Set("cache:12", "val", nil)
+		return nil
+	}) == nil)
+	b := db.Batch()
+	b.Set("session:4", "val", nil)
+	b.Set("session:5", "val", &SetOptions{Persist: true})
+	assert.Assert(b.Commit() == nil)
+	ttls := map[string]time.Duration{
+		"session:1":       time.Minute * 30,
+		"session:2":       time.Hour,
+		"session:3":       -1,
+		"session:4":       time.Minute * 30,
+		"session:5":       -1,
+		"session:admin:1": -1,
+		"cache:1":         time.Minute,
+		"cache:12":        -1,
+	}
+	assert.Assert(db.View(func(tx *Tx) error {
+		for key, expect := range ttls {
+			ttl, err := tx.TTL(key)
+			assert.Assert(err == nil && ttl == expect)
+		}
+		return nil
+	}) == nil)
+
+	// KeepTTL retains the existing expiration
+	assert.Assert(db.Update(func(tx *Tx) error {
+		tx.Set("session:3", "val2", &SetOptions{KeepTTL: true})
+		tx.Set("session:6", "val", &SetOptions{KeepTTL: true})
+		return nil
+	}) == nil)
+	assert.Assert(db.View(func(tx *Tx) error {
+		ttl, err := tx.TTL("session:3")
+		assert.Assert(err == nil && ttl == -1)
+		ttl, err = tx.TTL("session:6")
+		assert.Assert(err == nil && ttl == time.Minute*30)
+		return nil
+	}) == nil)
+
+	// updating the value of an existing key keeps its expiration
+	assert.Assert(db.Update(func(tx *Tx) error {
+		n, err := tx.IncrBy("session:counter", 1, nil)
+		assert.Assert(err == nil && n == 1)
+		return nil
+	}) == nil)
+	clock.Advance(time.Minute * 10)
+	assert.Assert(db.Update(func(tx *Tx) error {
+		n, err := tx.IncrBy("session:counter", 1, nil)
+		assert.Assert(err == nil && n == 2)
+		ttl, err := tx.TTL("session:counter")
+		assert.Assert(err == nil && ttl == time.Minute*20)
+		_, err = tx.Append("session:counter", "0", nil)
+		assert.Assert(err == nil)
+		assert.Assert(tx.CompareAndSwap("session:counter", "20", "30",
+			nil) == nil)
+		ttl, err = tx.TTL("session:counter")
+		assert.Assert(err == nil && ttl == time.Minute*20)
+		return nil
+	}) == nil)
+
+	// Persist cannot be combined with an expiration
+	conflicting := []*SetOptions{
+		{Persist: true, Expires: true, TTL: time.Hour},
+		{Persist: true, ExpiresAt: time.Now().Add(time.Hour)},
+		{Persist: true, KeepTTL: true},
+	}
+	assert.Assert(db.Update(func(tx *Tx) error {
+		for _, opts := range conflicting {
+			_, _, err := tx.Set("session:7", "val", opts)
+			assert.Assert(err == ErrInvalidOperation)
+		}
+		return nil
+	}) == nil)
+	for _, opts := range conflicting {
+		assert.Assert(db.Batch().Set("session:7", "val", opts) ==
+			ErrInvalidOperation)
+	}
+}
+
+func TestCompositeIndex(t *testing.T) {
+	db := testOpen(t)
+	defer testClose(db)
+	statuses := []string{"active", "closed", "pending"}
+	assert.Assert(db.Update(func(tx *Tx) error {
+		for i := 0; i < 30; i++ {
+			val := fmt.Sprintf(`{"status":"%s","created":%d}`,
+				statuses[i%3], 1000-i*10)
+			if _, _, err := tx.Set(fmt.Sprintf("doc:%02d", i), val,
+				nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	}) == nil)
+	assert.Assert(db.CreateCompositeIndex("status_created", "doc:*") ==
+		ErrInvalidOperation)
+	assert.Assert(db.CreateCompositeIndex("status_created", "doc:*",
+		IndexJSONField("status", nil),
+		IndexJSONField("created", IndexInt)) == nil)
+
+	rangeOf := func(tx *Tx, ge, lt []string) (keys []string, err error) {
+		err = tx.AscendCompositeRange("status_created", ge, lt,
+			func(key, value string) bool {
+				keys = append(keys, key)
+				return true
+			})
+		return keys, err
+	}
+	check := func(tx *Tx) {
+		// equality on the status, and a range on the created field
+		keys, err := rangeOf(tx, []string{"closed", "800"},
+			[]string{"closed", "910"})
+		assert.Assert(err == nil && len(keys) == 4)
+		assert.Assert(keys[0] == "doc:19" && keys[3] == "doc:10")
+
+		// a prefix includes all of the items with the leading fields
+		keys, err = rangeOf(tx, []string{"pending"}, []string{"pending"})
+		assert.Assert(err == nil && len(keys) == 10)
+		assert.Assert(keys[0] == "doc:29" && keys[9] == "doc:02")
+		keys, err = rangeOf(tx, []string{"active", "900"}, []string{"active"})
+		assert.Assert(err == nil && len(keys) == 4)
+		keys, err = rangeOf(tx, nil, nil)
+		assert.Assert(err == nil && len(keys) == 30)
+		keys, err = rangeOf(tx, []string{"closed"}, nil)
+		assert.Assert(err == nil && len(keys) == 20)
+
+		// the other iterators order the whole values by the fields
+		var keys2 []string
+		err = tx.Descend("status_created", func(key, value string) bool {
+			keys2 = append(keys2, key)
+			return len(keys2) < 2
+		})
+		assert.Assert(err == nil && keys2[0] == "doc:02" &&
+			keys2[1] == "doc:05")
+	}
+	assert.Assert(db.View(func(tx *Tx) error {
+		check(tx)
+		_, err := rangeOf(tx, []string{"a", "b", "c"}, nil)
+		assert.Assert(err == ErrInvalidOperation)
+		err = tx.AscendCompositeRange("missing", nil, nil,
+			func(key, value string) bool { return true })
+		assert.Assert(err == ErrNotFound)
+		return nil
+	}) == nil)
+	assert.Assert(db.ViewSnapshot(func(tx *Tx) error {
+		check(tx)
+		return nil
+	}) == nil)
+
+	// the index is kept up to date, and restored on rollback
+	assert.Assert(db.Update(func(tx *Tx) error {
+		_, _, err := tx.Set("doc:30", `{"status":"closed","created":850}`,
+			nil)
+		return err
+	}) == nil)
+	assert.Assert(db.Update(func(tx *Tx) error {
+		if err := tx.DropIndex("status_created"); err != nil {
+			return err
+		}
+		return errors.New("rollback")
+	}) != nil)
+	assert.Assert(db.View(func(tx *Tx) error {
+		keys, err := rangeOf(tx, []string{"closed", "800"},
+			[]string{"closed", "910"})
+		assert.Assert(err == nil && len(keys) == 5 && keys[2] == "doc:30")
+		return nil
+	}) == nil)
+}